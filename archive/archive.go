@@ -0,0 +1,129 @@
+// Package archive keeps the full-resolution originals of compressed JPEGs
+// so they can be restored later.
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/trash"
+)
+
+// DefaultFolder is the per-folder archive used when no archive folder is configured
+const DefaultFolder = ".originals"
+
+// Root returns the central archive folder, or "" if originals are kept per folder
+func Root(cfg *config.Config, rootDir string) string {
+	folder := cfg.Process.KeepOriginal.Folder
+	if folder == "" {
+		return ""
+	}
+	return config.ResolvePath(rootDir, folder)
+}
+
+// Path returns the archive location of the original of jpgPath
+func Path(cfg *config.Config, rootDir, jpgPath string) (string, error) {
+	archiveRoot := Root(cfg, rootDir)
+	if archiveRoot == "" {
+		return filepath.Join(filepath.Dir(jpgPath), DefaultFolder, filepath.Base(jpgPath)), nil
+	}
+
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(jpgPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the library %s", jpgPath, rootDir)
+	}
+	return filepath.Join(archiveRoot, rel), nil
+}
+
+// Store copies the original into the archive. An existing archived original
+// is kept, since it is older than the current file.
+func Store(cfg *config.Config, rootDir, jpgPath string) (string, error) {
+	archived, err := Path(cfg, rootDir, jpgPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(archived); err == nil {
+		return archived, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(archived), 0755); err != nil {
+		return "", fmt.Errorf("Error creating archive directory: %v", err)
+	}
+	if err := trash.CopyFile(jpgPath, archived); err != nil {
+		return "", fmt.Errorf("Error archiving %s: %v", jpgPath, err)
+	}
+	return archived, nil
+}
+
+// Restore moves the archived original back to jpgPath, replacing the current file
+func Restore(cfg *config.Config, rootDir, jpgPath string) error {
+	archived, err := Path(cfg, rootDir, jpgPath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(archived); err != nil {
+		return fmt.Errorf("No archived original for %s", jpgPath)
+	}
+
+	return trash.ReplaceFile(archived, jpgPath)
+}
+
+// List returns the library paths of all archived originals below dir
+func List(cfg *config.Config, rootDir, dir string) ([]string, error) {
+	var originals []string
+
+	archiveRoot := Root(cfg, rootDir)
+	if archiveRoot != "" {
+		absRoot, err := filepath.Abs(rootDir)
+		if err != nil {
+			return nil, err
+		}
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.Walk(archiveRoot, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(archiveRoot, path)
+			if err != nil {
+				return nil
+			}
+			original := filepath.Join(absRoot, rel)
+			if original == absDir || strings.HasPrefix(original, absDir+string(filepath.Separator)) {
+				originals = append(originals, original)
+			}
+			return nil
+		})
+		return originals, err
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || info.Name() != DefaultFolder {
+			return nil
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				originals = append(originals, filepath.Join(filepath.Dir(path), entry.Name()))
+			}
+		}
+		return filepath.SkipDir
+	})
+	return originals, err
+}
@@ -0,0 +1,95 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/frommie/rawmanager/config"
+)
+
+func TestPath(t *testing.T) {
+	rootDir := t.TempDir()
+	jpgPath := filepath.Join(rootDir, "2024", "shoot", "test.JPG")
+
+	tests := []struct {
+		name   string
+		folder string
+		want   string
+	}{
+		{
+			name:   "Per-folder archive",
+			folder: "",
+			want:   filepath.Join(rootDir, "2024", "shoot", DefaultFolder, "test.JPG"),
+		},
+		{
+			name:   "Central archive tree",
+			folder: "originals",
+			want:   filepath.Join(rootDir, "originals", "2024", "shoot", "test.JPG"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Process.KeepOriginal.Folder = tt.folder
+
+			got, err := Path(cfg, rootDir, jpgPath)
+			if err != nil {
+				t.Fatalf("Path() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Path() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreAndRestore(t *testing.T) {
+	for _, folder := range []string{"", "originals"} {
+		t.Run("folder="+folder, func(t *testing.T) {
+			rootDir := t.TempDir()
+			cfg := config.NewDefaultConfig()
+			cfg.Process.KeepOriginal.Folder = folder
+
+			jpgPath := filepath.Join(rootDir, "shoot", "test.JPG")
+			if err := os.MkdirAll(filepath.Dir(jpgPath), 0755); err != nil {
+				t.Fatalf("Setup failed: %v", err)
+			}
+			if err := os.WriteFile(jpgPath, []byte("ORIGINAL"), 0644); err != nil {
+				t.Fatalf("Setup failed: %v", err)
+			}
+
+			if _, err := Store(cfg, rootDir, jpgPath); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+			// A second store must keep the first original
+			if err := os.WriteFile(jpgPath, []byte("SMALL"), 0644); err != nil {
+				t.Fatalf("Setup failed: %v", err)
+			}
+			if _, err := Store(cfg, rootDir, jpgPath); err != nil {
+				t.Fatalf("Store() error = %v", err)
+			}
+
+			originals, err := List(cfg, rootDir, rootDir)
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			sort.Strings(originals)
+			if len(originals) != 1 || originals[0] != jpgPath {
+				t.Errorf("List() = %v, want [%s]", originals, jpgPath)
+			}
+
+			if err := Restore(cfg, rootDir, jpgPath); err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			if data, _ := os.ReadFile(jpgPath); string(data) != "ORIGINAL" {
+				t.Errorf("Restored content = %q, want ORIGINAL", data)
+			}
+			if err := Restore(cfg, rootDir, jpgPath); err == nil {
+				t.Error("Restore() without archived original should fail")
+			}
+		})
+	}
+}
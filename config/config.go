@@ -1,9 +1,16 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/frommie/rawmanager/rating"
 )
 
 type XmpMode string
@@ -17,51 +24,658 @@ const (
 
 	// XmpModeSeparateExt reads XMP data from .jpg.xmp sidecar file
 	XmpModeSeparateExt XmpMode = "separate_ext"
+
+	// XmpModeEmbeddedExif reads embedded XMP data and falls back to the
+	// EXIF rating if the XMP data or its rating is missing
+	XmpModeEmbeddedExif XmpMode = "embedded_exif"
+
+	// XmpModeLightroom reads the Lightroom Classic catalog set in
+	// xmp.lightroom.catalog
+	XmpModeLightroom XmpMode = "lightroom"
+
+	// XmpModeCaptureOne reads the Capture One session settings
+	// (CaptureOne/Settings*/DSCF6482.RAF.cos)
+	XmpModeCaptureOne XmpMode = "capture_one"
+
+	// XmpModeRawTherapee reads the RawTherapee/ART processing profile
+	// (DSCF6482.RAF.pp3)
+	XmpModeRawTherapee XmpMode = "rawtherapee"
+
+	// XmpModeAuto reads all rating sources in precedence order and resolves
+	// disagreeing ratings by the conflict policy
+	XmpModeAuto XmpMode = "auto"
+)
+
+type SourceName string
+
+const (
+	// SourceEmbedded is the XMP data in the JPEG's APP1 segment
+	SourceEmbedded SourceName = "embedded"
+
+	// SourceSeparate is the .xmp sidecar of the JPEG
+	SourceSeparate SourceName = "separate"
+
+	// SourceSeparateExt is the .jpg.xmp sidecar of the JPEG
+	SourceSeparateExt SourceName = "separate_ext"
+
+	// SourceExif is the EXIF Rating/RatingPercent of the JPEG
+	SourceExif SourceName = "exif"
+
+	// SourceRawSidecar is the XMP sidecar of the RAW (.RAF.xmp or .xmp)
+	SourceRawSidecar SourceName = "raw_sidecar"
+
+	// SourceLightroom is the Lightroom Classic catalog (.lrcat)
+	SourceLightroom SourceName = "lightroom"
+
+	// SourceCaptureOne is the Capture One session settings file (.cos)
+	SourceCaptureOne SourceName = "capture_one"
+
+	// SourceRawTherapee is the RawTherapee/ART processing profile (.pp3)
+	SourceRawTherapee SourceName = "rawtherapee"
+)
+
+// DefaultSources is the precedence order of the auto mode
+var DefaultSources = []SourceName{SourceEmbedded, SourceSeparateExt, SourceSeparate, SourceRawSidecar, SourceExif}
+
+// OptionalSources are built-in rating sources of other editors. They are
+// only read when selected as XMP mode or listed in the sources of the auto mode.
+var OptionalSources = []SourceName{SourceLightroom, SourceCaptureOne, SourceRawTherapee}
+
+type ConflictPolicy string
+
+const (
+	// ConflictHighest uses the highest of the disagreeing ratings
+	ConflictHighest ConflictPolicy = "highest"
+
+	// ConflictLowest uses the lowest of the disagreeing ratings
+	ConflictLowest ConflictPolicy = "lowest"
+
+	// ConflictNewest uses the rating of the most recently modified source
+	ConflictNewest ConflictPolicy = "newest-mtime"
+
+	// ConflictSkip leaves pairs with disagreeing ratings alone
+	ConflictSkip ConflictPolicy = "skip"
+
+	// ConflictFirst uses the first rated source in precedence order without
+	// comparing the others, as the single-source XMP modes do
+	ConflictFirst ConflictPolicy = "first"
+)
+
+// registeredSources holds the names of additional rating sources
+var registeredSources = map[SourceName]bool{}
+
+// RegisterSource makes the name of an additional rating source known to
+// Validate. It is called when the source is registered.
+func RegisterSource(name SourceName) {
+	registeredSources[name] = true
+}
+
+type DeleteMode string
+
+const (
+	// DeleteModeRemove deletes files permanently
+	DeleteModeRemove DeleteMode = "remove"
+
+	// DeleteModeQuarantine moves files into the library's quarantine folder
+	DeleteModeQuarantine DeleteMode = "quarantine"
+
+	// DeleteModeTrash moves files into the freedesktop.org trash (~/.local/share/Trash)
+	DeleteModeTrash DeleteMode = "trash"
 )
 
+// DefaultQuarantineDir is the quarantine folder relative to the library root
+const DefaultQuarantineDir = ".rawmanager/quarantine"
+
 type XmpConfig struct {
-	Mode XmpMode `yaml:"mode"` // XMP mode: embedded, separate, or separate_ext
+	Mode     XmpMode        `yaml:"mode"`     // XMP mode: embedded, separate, separate_ext, embedded_exif, lightroom, capture_one, rawtherapee, auto, or a registered source
+	Sources  []SourceName   `yaml:"sources"`  // Precedence order of the auto mode, empty for DefaultSources
+	Conflict ConflictPolicy `yaml:"conflict"` // highest, lowest, newest-mtime, skip, or first; empty defaults to skip
+
+	Lightroom LightroomConfig `yaml:"lightroom"` // Catalog of the lightroom source
+
+	// Scales converts percent-based ratings to stars per scale (microsoft,
+	// exif_percent or one of a custom source), missing scales use rating.Windows
+	Scales map[string]rating.Scale `yaml:"scales"`
+}
+
+// Scale returns the table converting ratings of a percent-based scale to stars
+func (x XmpConfig) Scale(name string) rating.Scale {
+	if scale, exists := x.Scales[name]; exists {
+		return scale
+	}
+	return rating.Windows
+}
+
+// LightroomConfig configures the Lightroom Classic catalog rating source
+type LightroomConfig struct {
+	Catalog string `yaml:"catalog"` // Path of the .lrcat file, opened read-only
 }
 
+// SourceOrder returns the rating sources of the auto mode in precedence order
+func (x XmpConfig) SourceOrder() []SourceName {
+	if len(x.Sources) == 0 {
+		return DefaultSources
+	}
+	return x.Sources
+}
+
+// ConflictPolicy returns the policy for rating sources that disagree
+func (x XmpConfig) ConflictPolicy() ConflictPolicy {
+	if x.Conflict == "" {
+		return ConflictSkip
+	}
+	return x.Conflict
+}
+
+// SourceChain returns the rating sources selected by the XMP mode in
+// precedence order and the policy combining them. Only the auto mode
+// compares sources, embedded_exif falls back from embedded XMP to EXIF.
+func (x XmpConfig) SourceChain() ([]SourceName, ConflictPolicy) {
+	switch x.Mode {
+	case XmpModeAuto:
+		return x.SourceOrder(), x.ConflictPolicy()
+	case XmpModeEmbeddedExif:
+		return []SourceName{SourceEmbedded, SourceExif}, ConflictFirst
+	default:
+		return []SourceName{SourceName(x.Mode)}, ConflictFirst
+	}
+}
+
+// RejectedRating is the rating of images marked as rejected (xmp:Rating -1)
+const RejectedRating = -1
+
 type Action struct {
 	DeleteRaw    bool `yaml:"deleteRaw"`
 	DeleteJpeg   bool `yaml:"deleteJpeg"`
 	CompressJpeg bool `yaml:"compressJpeg"`
 }
 
+// PickActions holds the actions for pick flags. A missing action leaves the
+// decision to labels and ratings.
+type PickActions struct {
+	Picked    *Action `yaml:"picked"`
+	Rejected  *Action `yaml:"rejected"`
+	Unflagged *Action `yaml:"unflagged"`
+}
+
+// KeywordRule overrides the action of images tagged with one of its keywords.
+// Unset fields keep the decision of ratings, labels and pick flags.
+type KeywordRule struct {
+	Keywords     []string `yaml:"keywords"`     // Flat keywords, hierarchical paths or their leaves
+	DeleteRaw    *bool    `yaml:"deleteRaw"`    // false: never delete the RAW, true: always delete it
+	DeleteJpeg   *bool    `yaml:"deleteJpeg"`   // false: never delete the JPEG, true: always delete it
+	CompressJpeg *bool    `yaml:"compressJpeg"` // false: never compress the JPEG, true: always compress it
+}
+
+// Extensions is a list of file extensions in pairing order. YAML accepts a
+// single extension as well, e.g. rawExtension: ".RAF".
+type Extensions []string
+
+func (e *Extensions) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*e = Extensions{value.Value}
+		return nil
+	}
+	var exts []string
+	if err := value.Decode(&exts); err != nil {
+		return err
+	}
+	*e = exts
+	return nil
+}
+
 type FileConfig struct {
-	RawExtension  string `yaml:"rawExtension"`  // e.g. ".RAF"
-	JpegExtension string `yaml:"jpegExtension"` // e.g. ".JPG"
-	RawFolder     string `yaml:"rawFolder"`     // e.g. "raw" or "."
-	SameDir       bool   `yaml:"sameDir"`       // true if RAWs are in same directory
+	RawExtension   Extensions `yaml:"rawExtension"`   // e.g. ".RAF" or [".CR3", ".NEF"]
+	JpegExtension  Extensions `yaml:"jpegExtension"`  // e.g. ".JPG" or [".JPG", ".jpeg"]
+	HeifExtensions Extensions `yaml:"heifExtensions"` // e.g. [".HIF", ".HEIC"], rated like JPEGs but never compressed
+	RawFolder      string     `yaml:"rawFolder"`      // e.g. "raw" or "."
+	SameDir        bool       `yaml:"sameDir"`        // true if RAWs are in same directory
+	RawOnly        bool       `yaml:"rawOnly"`        // Rate RAWs by their XMP sidecars, JPEGs are ignored
+}
+
+// RawExts returns the RAW extensions in pairing order
+func (f FileConfig) RawExts() []string {
+	return extensions(f.RawExtension)
+}
+
+// JpegExts returns the JPEG extensions in pairing order
+func (f FileConfig) JpegExts() []string {
+	return extensions(f.JpegExtension)
+}
+
+// CompanionExtensions returns the extensions of the rated companions of a
+// RAW, the JPEG extensions first
+func (f FileConfig) CompanionExtensions() []string {
+	return extensions(append(f.JpegExts(), f.HeifExtensions...))
+}
+
+// RawExtensionOf returns the RAW extension name ends with, matched
+// case-insensitively
+func (f FileConfig) RawExtensionOf(name string) (string, bool) {
+	return matchExtension(name, f.RawExts())
+}
+
+// CompanionExtension returns the companion extension name ends with, matched
+// case-insensitively
+func (f FileConfig) CompanionExtension(name string) (string, bool) {
+	return matchExtension(name, f.CompanionExtensions())
+}
+
+// IsHeif reports whether name has one of the HEIF extensions
+func (f FileConfig) IsHeif(name string) bool {
+	_, heif := matchExtension(name, f.HeifExtensions)
+	return heif
+}
+
+// extensions drops empty extensions and those repeated in another case
+func extensions(exts []string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, ext := range exts {
+		if ext == "" || seen[strings.ToUpper(ext)] {
+			continue
+		}
+		seen[strings.ToUpper(ext)] = true
+		result = append(result, ext)
+	}
+	return result
+}
+
+// matchExtension returns the first of exts that name ends with, ignoring case
+func matchExtension(name string, exts []string) (string, bool) {
+	for _, ext := range exts {
+		if ext != "" && strings.HasSuffix(strings.ToUpper(name), strings.ToUpper(ext)) {
+			return ext, true
+		}
+	}
+	return "", false
+}
+
+type SidecarNaming string
+
+const (
+	// SidecarNamingExt names sidecars after the full RAW name (DSCF0001.RAF.xmp)
+	// as darktable, RawTherapee and digiKam do
+	SidecarNamingExt SidecarNaming = "ext"
+
+	// SidecarNamingBase names sidecars after the RAW without its extension
+	// (DSCF0001.xmp) as Lightroom and Capture One do
+	SidecarNamingBase SidecarNaming = "base"
+)
+
+// RawSidecarConfig controls copying the JPEG's rating, label and keywords
+// into the XMP sidecar of its RAW
+type RawSidecarConfig struct {
+	Write  bool          `yaml:"write"`  // Create or update the sidecar of surviving RAWs
+	Naming SidecarNaming `yaml:"naming"` // ext or base, empty defaults to ext
+}
+
+type DeleteConfig struct {
+	Mode          DeleteMode `yaml:"mode"`          // Delete mode: remove, quarantine, or trash
+	QuarantineDir string     `yaml:"quarantineDir"` // relative to the library root or absolute
+}
+
+type KeepOriginalConfig struct {
+	Enabled bool   `yaml:"enabled"` // Archive originals before compressing them
+	Folder  string `yaml:"folder"`  // Archive tree, empty for a .originals folder per directory
 }
 
 type ProcessConfig struct {
-	TargetMegapixels float64 `yaml:"targetMegapixels"` // Target size for JPEG compression
-	JpegQuality      int     `yaml:"jpegQuality"`      // JPEG quality (0-100)
+	TargetMegapixels float64            `yaml:"targetMegapixels"` // Target size for JPEG compression
+	JpegQuality      int                `yaml:"jpegQuality"`      // JPEG quality (0-100)
+	KeepOriginal     KeepOriginalConfig `yaml:"keepOriginal"`
+	JournalBackup    bool               `yaml:"journalBackup"` // Keep compressed originals next to the journal for undo
+}
+
+type OrphanAction string
+
+const (
+	// OrphanKeep leaves RAWs without JPEG alone
+	OrphanKeep OrphanAction = "keep"
+
+	// OrphanDelete deletes RAWs without JPEG
+	OrphanDelete OrphanAction = "delete"
+
+	// OrphanMove moves RAWs without JPEG into the orphan folder
+	OrphanMove OrphanAction = "move"
+)
+
+// DefaultOrphanDir is the orphan folder relative to the library root
+const DefaultOrphanDir = ".rawmanager/orphans"
+
+// OrphanConfig is the policy for RAWs whose JPEG is missing
+type OrphanConfig struct {
+	Action    OrphanAction `yaml:"action"`    // keep, delete, or move; empty follows noJpegAction
+	AfterDays int          `yaml:"afterDays"` // Only act once the RAW has been orphaned this many days
+	MoveTo    string       `yaml:"moveTo"`    // Orphan folder, relative to the library root or absolute
+}
+
+// KeepMarker protects a folder (and its subfolders) when placed inside it,
+// or a single file when named <file>.rawmanager-keep
+const KeepMarker = ".rawmanager-keep"
+
+// ProtectConfig lists additional markers that veto any destructive action.
+// Keep marker files are always honored.
+type ProtectConfig struct {
+	ReadOnly bool     `yaml:"readOnly"` // Protect files without write permission
+	Labels   []string `yaml:"labels"`   // Protect pairs with one of these XMP color labels
+	Keywords []string `yaml:"keywords"` // Protect pairs with one of these XMP keywords
+}
+
+// LimitsConfig holds the safety limits of a run, zero disables a limit
+type LimitsConfig struct {
+	MaxRawDeletesPerFolder       int     `yaml:"maxRawDeletesPerFolder"`       // RAWs deleted per folder
+	MaxRawDeletePercentPerFolder float64 `yaml:"maxRawDeletePercentPerFolder"` // Percentage of a folder's RAWs deleted
+	MaxRawDeletesPerRun          int     `yaml:"maxRawDeletesPerRun"`          // RAWs deleted per run
+	MaxRawDeletePercentPerRun    float64 `yaml:"maxRawDeletePercentPerRun"`    // Percentage of all RAWs deleted
+	MaxBytesRemoved              int64   `yaml:"maxBytesRemoved"`              // Total bytes of deleted files
+	MaxRatingErrorPercent        float64 `yaml:"maxRatingErrorPercent"`        // Percentage of failed rating reads
 }
 
 type Config struct {
-	RatingActions map[int]Action `yaml:"ratingActions"`
-	NoJpegAction  Action         `yaml:"noJpegAction"`
-	Xmp           XmpConfig      `yaml:"xmp"`
-	Files         FileConfig     `yaml:"files"`
-	Process       ProcessConfig  `yaml:"process"`
+	RatingActions map[int]Action    `yaml:"ratingActions"`
+	RejectAction  Action            `yaml:"rejectAction"` // Action for rejected images (rating -1)
+	LabelActions  map[string]Action `yaml:"labelActions"` // Actions per color label (xmp:Label)
+	PickActions   PickActions       `yaml:"pickActions"`  // Actions per pick flag
+	KeywordRules  []KeywordRule     `yaml:"keywordRules"` // Keyword overrides on top of all actions
+	NoJpegAction  Action            `yaml:"noJpegAction"`
+	Xmp           XmpConfig         `yaml:"xmp"`
+	Files         FileConfig        `yaml:"files"`
+	RawSidecar    RawSidecarConfig  `yaml:"rawSidecar"`
+	Process       ProcessConfig     `yaml:"process"`
+	Delete        DeleteConfig      `yaml:"delete"`
+	Limits        LimitsConfig      `yaml:"limits"`
+	Protect       ProtectConfig     `yaml:"protect"`
+	Orphan        OrphanConfig      `yaml:"orphan"`
+	Incremental   bool              `yaml:"incremental"` // Skip pairs that are unchanged since the last run
+}
+
+// Hash identifies the settings that decide the actions of a pair, e.g. to
+// invalidate cached evaluations. Settings that only change how actions are
+// executed, such as limits, delete mode or compression, are left out.
+func (c *Config) Hash() string {
+	data, err := json.Marshal(struct {
+		RatingActions map[int]Action
+		RejectAction  Action
+		LabelActions  map[string]Action
+		PickActions   PickActions
+		KeywordRules  []KeywordRule
+		NoJpegAction  Action
+		Xmp           XmpConfig
+		Files         FileConfig
+		RawSidecar    RawSidecarConfig
+		Protect       ProtectConfig
+		Orphan        OrphanConfig
+	}{
+		c.RatingActions, c.RejectAction, c.LabelActions, c.PickActions, c.KeywordRules,
+		c.NoJpegAction, c.Xmp, c.Files, c.RawSidecar, c.Protect, c.Orphan,
+	})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ActionFor returns the configured action for a rating, rejected images
+// use RejectAction
+func (c *Config) ActionFor(rating int) (Action, bool) {
+	if rating == RejectedRating {
+		return c.RejectAction, true
+	}
+	action, exists := c.RatingActions[rating]
+	return action, exists
+}
+
+// LabelAction returns the configured action for a color label. Labels are
+// matched case-insensitively.
+func (c *Config) LabelAction(label string) (Action, bool) {
+	if label == "" {
+		return Action{}, false
+	}
+	for name, action := range c.LabelActions {
+		if strings.EqualFold(name, label) {
+			return action, true
+		}
+	}
+	return Action{}, false
+}
+
+// PickAction returns the configured action for a pick flag
+// ("picked", "rejected" or "unflagged")
+func (c *Config) PickAction(pick string) (Action, bool) {
+	var action *Action
+	switch pick {
+	case "picked":
+		action = c.PickActions.Picked
+	case "rejected":
+		action = c.PickActions.Rejected
+	case "unflagged":
+		action = c.PickActions.Unflagged
+	}
+	if action == nil {
+		return Action{}, false
+	}
+	return *action, true
+}
+
+// ApplyKeywordRules overrides action with the rules matching hasKeyword.
+// If rules disagree, keeping a file wins over deleting or compressing it.
+func (c *Config) ApplyKeywordRules(action Action, hasKeyword func(string) bool) (Action, []string) {
+	var matched []string
+	var forced, vetoed Action
+	for _, rule := range c.KeywordRules {
+		keyword := ""
+		for _, k := range rule.Keywords {
+			if hasKeyword(k) {
+				keyword = k
+				break
+			}
+		}
+		if keyword == "" {
+			continue
+		}
+		matched = append(matched, keyword)
+		applyOverride(rule.DeleteRaw, &forced.DeleteRaw, &vetoed.DeleteRaw)
+		applyOverride(rule.DeleteJpeg, &forced.DeleteJpeg, &vetoed.DeleteJpeg)
+		applyOverride(rule.CompressJpeg, &forced.CompressJpeg, &vetoed.CompressJpeg)
+	}
+
+	action.DeleteRaw = (action.DeleteRaw || forced.DeleteRaw) && !vetoed.DeleteRaw
+	action.DeleteJpeg = (action.DeleteJpeg || forced.DeleteJpeg) && !vetoed.DeleteJpeg
+	action.CompressJpeg = (action.CompressJpeg || forced.CompressJpeg) && !vetoed.CompressJpeg
+	return action, matched
+}
+
+// applyOverride records a single keyword override
+func applyOverride(override *bool, forced, vetoed *bool) {
+	if override == nil {
+		return
+	}
+	if *override {
+		*forced = true
+	} else {
+		*vetoed = true
+	}
+}
+
+// OrphanPolicy returns the action for orphaned RAWs. Without an explicit
+// orphan action noJpegAction.deleteRaw decides between delete and keep.
+func (c *Config) OrphanPolicy() OrphanAction {
+	if c.Orphan.Action != "" {
+		return c.Orphan.Action
+	}
+	if c.NoJpegAction.DeleteRaw {
+		return OrphanDelete
+	}
+	return OrphanKeep
+}
+
+// ResolvePath returns dir relative to the library root unless it is absolute
+func ResolvePath(rootDir, dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(rootDir, dir)
+}
+
+// InternalDirs returns the folders rawmanager writes to inside a library,
+// which must never be processed themselves
+func (c *Config) InternalDirs(rootDir string) []string {
+	var dirs []string
+	if c.Delete.QuarantineDir != "" {
+		dirs = append(dirs, ResolvePath(rootDir, c.Delete.QuarantineDir))
+	}
+	if c.Process.KeepOriginal.Folder != "" {
+		dirs = append(dirs, ResolvePath(rootDir, c.Process.KeepOriginal.Folder))
+	}
+	if c.Orphan.MoveTo != "" {
+		dirs = append(dirs, ResolvePath(rootDir, c.Orphan.MoveTo))
+	}
+	return dirs
 }
 
 func (c *Config) Validate() error {
 	// Validate XMP-Mode
 	validModes := map[XmpMode]bool{
-		XmpModeEmbedded:    true,
-		XmpModeSeparate:    true,
-		XmpModeSeparateExt: true,
+		XmpModeEmbedded:     true,
+		XmpModeSeparate:     true,
+		XmpModeSeparateExt:  true,
+		XmpModeEmbeddedExif: true,
+		XmpModeLightroom:    true,
+		XmpModeCaptureOne:   true,
+		XmpModeRawTherapee:  true,
+		XmpModeAuto:         true,
 	}
-	if !validModes[c.Xmp.Mode] {
+	if !validModes[c.Xmp.Mode] && !registeredSources[SourceName(c.Xmp.Mode)] {
 		return fmt.Errorf("Invalid XMP-Mode: %s", c.Xmp.Mode)
 	}
+
+	// Validate file extensions, a RAW extension must not be a companion's
+	for _, ext := range append(c.Files.RawExts(), c.Files.CompanionExtensions()...) {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("Invalid file extension: %s", ext)
+		}
+	}
+	for _, ext := range c.Files.RawExts() {
+		if _, companion := matchExtension(ext, c.Files.CompanionExtensions()); companion {
+			return fmt.Errorf("Invalid file extension: %s is both RAW and companion", ext)
+		}
+	}
+
+	// Validate rating sources and conflict policy of the auto mode
+	seenSources := map[SourceName]bool{}
+	for _, source := range c.Xmp.Sources {
+		if !isKnownSource(source) {
+			return fmt.Errorf("Invalid rating source: %s", source)
+		}
+		if seenSources[source] {
+			return fmt.Errorf("Duplicate rating source: %s", source)
+		}
+		seenSources[source] = true
+	}
+	if (seenSources[SourceLightroom] || c.Xmp.Mode == XmpModeLightroom) && c.Xmp.Lightroom.Catalog == "" {
+		return fmt.Errorf("Invalid rating source: lightroom needs xmp.lightroom.catalog")
+	}
+	for name, scale := range c.Xmp.Scales {
+		if name == rating.ScaleStars {
+			return fmt.Errorf("Invalid rating scale: %s is not percent-based", name)
+		}
+		if err := scale.Validate(); err != nil {
+			return fmt.Errorf("Invalid rating scale %s: %v", name, err)
+		}
+	}
+	validPolicies := map[ConflictPolicy]bool{
+		"":              true,
+		ConflictHighest: true,
+		ConflictLowest:  true,
+		ConflictNewest:  true,
+		ConflictSkip:    true,
+		ConflictFirst:   true,
+	}
+	if !validPolicies[c.Xmp.Conflict] {
+		return fmt.Errorf("Invalid conflict policy: %s", c.Xmp.Conflict)
+	}
+
+	// Validate ratings, rejected images have their own action
+	for rating := range c.RatingActions {
+		if rating < 0 || rating > 5 {
+			return fmt.Errorf("Invalid rating in ratingActions: %d (use rejectAction for rejected images)", rating)
+		}
+	}
+
+	// Validate labels
+	for label := range c.LabelActions {
+		if strings.TrimSpace(label) == "" {
+			return fmt.Errorf("Invalid label in labelActions: label must not be empty")
+		}
+	}
+
+	// Validate keyword rules
+	for i, rule := range c.KeywordRules {
+		if len(rule.Keywords) == 0 {
+			return fmt.Errorf("Invalid keyword rule %d: no keywords", i+1)
+		}
+		if rule.DeleteRaw == nil && rule.DeleteJpeg == nil && rule.CompressJpeg == nil {
+			return fmt.Errorf("Invalid keyword rule %d: no override", i+1)
+		}
+	}
+
+	// Validate sidecar naming, empty defaults to ext
+	switch c.RawSidecar.Naming {
+	case "", SidecarNamingExt, SidecarNamingBase:
+	default:
+		return fmt.Errorf("Invalid sidecar naming: %s", c.RawSidecar.Naming)
+	}
+
+	// Validate delete mode, empty defaults to remove
+	validDeleteModes := map[DeleteMode]bool{
+		"":                   true,
+		DeleteModeRemove:     true,
+		DeleteModeQuarantine: true,
+		DeleteModeTrash:      true,
+	}
+	if !validDeleteModes[c.Delete.Mode] {
+		return fmt.Errorf("Invalid delete mode: %s", c.Delete.Mode)
+	}
+
+	// Validate orphan policy, empty follows noJpegAction
+	validOrphanActions := map[OrphanAction]bool{
+		"":           true,
+		OrphanKeep:   true,
+		OrphanDelete: true,
+		OrphanMove:   true,
+	}
+	if !validOrphanActions[c.Orphan.Action] {
+		return fmt.Errorf("Invalid orphan action: %s", c.Orphan.Action)
+	}
+	if c.Orphan.AfterDays < 0 {
+		return fmt.Errorf("Invalid orphan afterDays: %d", c.Orphan.AfterDays)
+	}
+
+	// Validate limits
+	l := c.Limits
+	if l.MaxRawDeletesPerFolder < 0 || l.MaxRawDeletesPerRun < 0 || l.MaxBytesRemoved < 0 {
+		return fmt.Errorf("Invalid limits: values must not be negative")
+	}
+	for _, percent := range []float64{l.MaxRawDeletePercentPerFolder, l.MaxRawDeletePercentPerRun, l.MaxRatingErrorPercent} {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("Invalid limits: percentages must be between 0 and 100")
+		}
+	}
 	return nil
 }
 
+// isKnownSource reports whether source is a built-in or registered rating source
+func isKnownSource(source SourceName) bool {
+	for _, known := range append(DefaultSources, OptionalSources...) {
+		if source == known {
+			return true
+		}
+	}
+	return registeredSources[source]
+}
+
 // LoadConfig loads config from yaml file
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
@@ -92,17 +706,32 @@ func NewDefaultConfig() *Config {
 			4: {DeleteRaw: false, DeleteJpeg: false, CompressJpeg: false},
 			5: {DeleteRaw: false, DeleteJpeg: false, CompressJpeg: false},
 		},
+		RejectAction: Action{DeleteRaw: false, DeleteJpeg: false, CompressJpeg: false},
 		NoJpegAction: Action{DeleteRaw: true, DeleteJpeg: false, CompressJpeg: false},
 		Xmp:          XmpConfig{Mode: XmpModeEmbedded},
 		Files: FileConfig{
-			RawExtension:  ".RAF",
-			JpegExtension: ".JPG",
-			RawFolder:     "raw",
-			SameDir:       false,
+			RawExtension:   Extensions{".RAF"},
+			JpegExtension:  Extensions{".JPG"},
+			HeifExtensions: Extensions{".HIF", ".HEIC"},
+			RawFolder:      "raw",
+			SameDir:        false,
 		},
 		Process: ProcessConfig{
 			TargetMegapixels: 10.0,
 			JpegQuality:      95,
 		},
+		Delete: DeleteConfig{
+			Mode:          DeleteModeRemove,
+			QuarantineDir: DefaultQuarantineDir,
+		},
+		Protect: ProtectConfig{
+			ReadOnly: true,
+		},
+		Orphan: OrphanConfig{
+			Action:    OrphanDelete,
+			AfterDays: 0,
+			MoveTo:    DefaultOrphanDir,
+		},
+		Incremental: true,
 	}
 }
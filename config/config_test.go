@@ -20,6 +20,228 @@ xmp:
 `,
 			wantErr: true,
 		},
+		{
+			name: "Negative limit",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+limits:
+  maxRawDeletesPerRun: -1
+`,
+			wantErr: true,
+		},
+		{
+			name: "Percentage limit above 100",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+limits:
+  maxRawDeletePercentPerFolder: 150
+`,
+			wantErr: true,
+		},
+		{
+			name: "Rejected rating in ratingActions",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+ratingActions:
+  -1:
+    deleteRaw: true
+`,
+			wantErr: true,
+		},
+		{
+			name: "Valid reject action",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+rejectAction:
+  deleteRaw: true
+  deleteJpeg: true
+`,
+			wantErr: false,
+		},
+		{
+			name: "Empty label in labelActions",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+labelActions:
+  "":
+    deleteRaw: true
+`,
+			wantErr: true,
+		},
+		{
+			name: "Keyword rule without override",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+keywordRules:
+  - keywords: [portfolio]
+`,
+			wantErr: true,
+		},
+		{
+			name: "Valid keyword rule",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+keywordRules:
+  - keywords: [portfolio, print]
+    deleteRaw: false
+`,
+			wantErr: false,
+		},
+		{
+			name: "Invalid sidecar naming",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+rawSidecar:
+  write: true
+  naming: "darktable"
+`,
+			wantErr: true,
+		},
+		{
+			name: "Unknown rating source",
+			yamlContent: `
+xmp:
+  mode: "auto"
+  sources: [embedded, picasa]
+`,
+			wantErr: true,
+		},
+		{
+			name: "Invalid conflict policy",
+			yamlContent: `
+xmp:
+  mode: "auto"
+  conflict: "average"
+`,
+			wantErr: true,
+		},
+		{
+			name: "Valid auto mode",
+			yamlContent: `
+xmp:
+  mode: "auto"
+  sources: [separate_ext, embedded, exif]
+  conflict: "newest-mtime"
+`,
+			wantErr: false,
+		},
+		{
+			name: "Extension without dot",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+files:
+  rawExtension: ["CR3"]
+`,
+			wantErr: true,
+		},
+		{
+			name: "Extension both RAW and companion",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+files:
+  jpegExtension: ".JPG"
+  rawExtension: [".CR3", ".jpg"]
+`,
+			wantErr: true,
+		},
+		{
+			name: "Valid multiple extensions",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+files:
+  rawExtension: [".CR3", ".NEF"]
+  jpegExtension: [".JPG", ".jpeg"]
+`,
+			wantErr: false,
+		},
+		{
+			name: "Lightroom source without catalog",
+			yamlContent: `
+xmp:
+  mode: "auto"
+  sources: [lightroom, embedded]
+`,
+			wantErr: true,
+		},
+		{
+			name: "Valid Lightroom source",
+			yamlContent: `
+xmp:
+  mode: "auto"
+  sources: [lightroom, embedded]
+  conflict: "first"
+  lightroom:
+    catalog: "/photos/Lightroom Catalog.lrcat"
+`,
+			wantErr: false,
+		},
+		{
+			name: "Lightroom mode without catalog",
+			yamlContent: `
+xmp:
+  mode: "lightroom"
+`,
+			wantErr: true,
+		},
+		{
+			name: "Valid Lightroom mode",
+			yamlContent: `
+xmp:
+  mode: "lightroom"
+  lightroom:
+    catalog: "/photos/Lightroom Catalog.lrcat"
+`,
+			wantErr: false,
+		},
+		{
+			name: "Overlapping rating scale",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+  scales:
+    microsoft:
+      - {min: 1, max: 50, stars: 1}
+      - {min: 50, max: 99, stars: 5}
+`,
+			wantErr: true,
+		},
+		{
+			name: "Valid rating scale",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+  scales:
+    exif_percent:
+      - {min: 1, max: 20, stars: 1}
+      - {min: 21, max: 40, stars: 2}
+      - {min: 41, max: 60, stars: 3}
+      - {min: 61, max: 80, stars: 4}
+      - {min: 81, max: 100, stars: 5}
+`,
+			wantErr: false,
+		},
+		{
+			name: "Valid limits",
+			yamlContent: `
+xmp:
+  mode: "embedded"
+limits:
+  maxRawDeletesPerRun: 100
+  maxRawDeletePercentPerFolder: 50
+`,
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -38,3 +260,67 @@ xmp:
 		})
 	}
 }
+
+func TestRegisteredSourceMode(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.Xmp.Mode = "review"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() accepted an unknown XMP mode")
+	}
+
+	// A registered source can be selected as XMP mode on its own
+	RegisterSource("review")
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	names, policy := cfg.Xmp.SourceChain()
+	if len(names) != 1 || names[0] != "review" || policy != ConflictFirst {
+		t.Errorf("SourceChain() = %v, %s, want [review], first", names, policy)
+	}
+}
+
+func TestHash(t *testing.T) {
+	base := NewDefaultConfig().Hash()
+
+	// Settings that only change how actions are executed keep the hash
+	cfg := NewDefaultConfig()
+	cfg.Limits.MaxRawDeletesPerRun = 10
+	cfg.Delete.Mode = DeleteModeQuarantine
+	cfg.Process.JpegQuality = 50
+	if cfg.Hash() != base {
+		t.Error("Hash() changed with execution settings")
+	}
+
+	cfg = NewDefaultConfig()
+	cfg.RatingActions[3] = Action{DeleteRaw: true}
+	if cfg.Hash() == base {
+		t.Error("Hash() unchanged with different rating actions")
+	}
+}
+
+func TestExtensionsYAML(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	yamlContent := `
+xmp:
+  mode: "embedded"
+files:
+  rawExtension: ".RAF"
+  jpegExtension: [".JPG", ".jpeg"]
+`
+	if err := os.WriteFile(configPath, []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	// A single extension of older configs is a list of one
+	if got := cfg.Files.RawExts(); len(got) != 1 || got[0] != ".RAF" {
+		t.Errorf("RawExts() = %v, want [.RAF]", got)
+	}
+	if got := cfg.Files.JpegExts(); len(got) != 2 || got[1] != ".jpeg" {
+		t.Errorf("JpegExts() = %v, want [.JPG .jpeg]", got)
+	}
+}
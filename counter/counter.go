@@ -3,6 +3,7 @@ package counter
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/frommie/rawmanager/config"
@@ -11,24 +12,49 @@ import (
 type FileCounter struct {
 	JpegCount int
 	RawCount  int
+
+	// ByExtension counts the JPEG, HEIF and RAW files per extension, e.g. ".CR3"
+	ByExtension map[string]int
 }
 
 func (c *FileCounter) CountFiles(rootDir string, config *config.Config) error {
+	if c.ByExtension == nil {
+		c.ByExtension = map[string]int{}
+	}
+	var internalDirs []string
+	for _, dir := range config.InternalDirs(rootDir) {
+		internalDirs = append(internalDirs, absPath(dir))
+	}
 	return filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Überspringe Fehler
 		}
 
+		// Skip hidden directories and the folders rawmanager writes to
+		if info.IsDir() && path != rootDir && (strings.HasPrefix(info.Name(), ".") || slices.Contains(internalDirs, absPath(path))) {
+			return filepath.SkipDir
+		}
+
 		if !info.IsDir() {
-			// Count JPEGs
-			if strings.HasSuffix(strings.ToUpper(info.Name()), config.Files.JpegExtension) {
+			// Count JPEGs and HEIFs
+			if ext, companion := config.Files.CompanionExtension(info.Name()); companion {
 				c.JpegCount++
+				c.ByExtension[strings.ToUpper(ext)]++
 			}
 			// Count RAWs
-			if strings.HasSuffix(strings.ToUpper(info.Name()), config.Files.RawExtension) {
+			if ext, raw := config.Files.RawExtensionOf(info.Name()); raw {
 				c.RawCount++
+				c.ByExtension[strings.ToUpper(ext)]++
 			}
 		}
 		return nil
 	})
 }
+
+// absPath returns the absolute, cleaned form of path
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
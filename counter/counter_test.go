@@ -14,6 +14,7 @@ func TestFileCounter_CountFiles(t *testing.T) {
 		setupFiles    []string
 		wantJpegCount int
 		wantRawCount  int
+		wantByExt     map[string]int
 		config        *config.Config
 	}{
 		{
@@ -45,6 +46,26 @@ func TestFileCounter_CountFiles(t *testing.T) {
 			wantJpegCount: 2,
 			wantRawCount:  2,
 		},
+		{
+			name: "Multiple extensions",
+			setupFiles: []string{
+				"foto1.JPG",
+				"foto1.RAF",
+				"foto2.jpeg",
+				"foto2.CR3",
+				"foto3.jpg",
+				"foto3.nef",
+			},
+			wantJpegCount: 3,
+			wantRawCount:  3,
+			wantByExt:     map[string]int{".JPG": 2, ".JPEG": 1, ".RAF": 1, ".CR3": 1, ".NEF": 1},
+			config: func() *config.Config {
+				cfg := config.NewDefaultConfig()
+				cfg.Files.RawExtension = config.Extensions{".RAF", ".CR3", ".NEF"}
+				cfg.Files.JpegExtension = config.Extensions{".JPG", ".jpeg"}
+				return cfg
+			}(),
+		},
 	}
 
 	for _, tt := range tests {
@@ -80,6 +101,45 @@ func TestFileCounter_CountFiles(t *testing.T) {
 			if counter.RawCount != tt.wantRawCount {
 				t.Errorf("RawCount = %v, want %v", counter.RawCount, tt.wantRawCount)
 			}
+			for ext, want := range tt.wantByExt {
+				if counter.ByExtension[ext] != want {
+					t.Errorf("ByExtension[%s] = %v, want %v", ext, counter.ByExtension[ext], want)
+				}
+			}
 		})
 	}
 }
+
+func TestCountFilesSkipsInternalDirs(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, file := range []string{"foto1.JPG", "foto1.RAF", "orphans/foto2.RAF"} {
+		path := filepath.Join(tmpDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Error while creating the test directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("test"), 0644); err != nil {
+			t.Fatalf("Error creating the test file: %v", err)
+		}
+	}
+
+	// A relative library root and an absolute internal folder name the
+	// same folder differently
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootDir, err := filepath.Rel(wd, tmpDir)
+	if err != nil {
+		t.Skipf("No relative path to %s: %v", tmpDir, err)
+	}
+	cfg := config.NewDefaultConfig()
+	cfg.Orphan.MoveTo = filepath.Join(tmpDir, "orphans") + string(filepath.Separator)
+
+	counter := &FileCounter{}
+	if err := counter.CountFiles(rootDir+string(filepath.Separator), cfg); err != nil {
+		t.Fatalf("CountFiles() error = %v", err)
+	}
+	if counter.RawCount != 1 {
+		t.Errorf("RawCount = %v, want 1 without the internal folder", counter.RawCount)
+	}
+}
@@ -0,0 +1,123 @@
+// Package exif reads ratings that cameras and Windows Explorer write into
+// the EXIF data of a JPEG instead of XMP.
+package exif
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dsoprea/go-exif/v3"
+	"github.com/dsoprea/go-jpeg-image-structure/v2"
+	"github.com/frommie/rawmanager/rating"
+)
+
+const (
+	// tagRating is the star rating (0-5) in IFD0
+	tagRating = 0x4746
+
+	// tagRatingPercent is the rating as percentage (0-99) in IFD0
+	tagRatingPercent = 0x4749
+)
+
+// Rating is an EXIF rating with the scale it was read in
+type Rating struct {
+	Stars   int    // Star rating, 0 for percent-based scales until converted
+	Scale   string // rating.ScaleStars or rating.ScaleExifPercent
+	Percent int    // Value of the RatingPercent tag
+}
+
+// GetRatingFromFile reads the EXIF rating of a JPEG file, percentages are
+// converted with the Windows table
+func GetRatingFromFile(jpgPath string) (int, error) {
+	r, err := ReadRatingFromFile(jpgPath)
+	if err != nil {
+		return 0, err
+	}
+	return r.StarsIn(rating.Windows)
+}
+
+// GetRating reads the EXIF rating of JPEG data, percentages are converted
+// with the Windows table
+func GetRating(jpgData []byte) (int, error) {
+	r, err := ReadRating(jpgData)
+	if err != nil {
+		return 0, err
+	}
+	return r.StarsIn(rating.Windows)
+}
+
+// StarsIn returns the star rating, converting percentages with the given table
+func (r Rating) StarsIn(scale rating.Scale) (int, error) {
+	if r.Scale != rating.ScaleExifPercent {
+		return r.Stars, nil
+	}
+	stars, err := scale.Stars(r.Percent)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid EXIF rating percent: %v", err)
+	}
+	return stars, nil
+}
+
+// ReadRatingFromFile reads the EXIF rating of a JPEG file with its scale
+func ReadRatingFromFile(jpgPath string) (Rating, error) {
+	data, err := os.ReadFile(jpgPath)
+	if err != nil {
+		return Rating{}, fmt.Errorf("Error reading file: %v", err)
+	}
+	return ReadRating(data)
+}
+
+// ReadRating reads the EXIF rating of JPEG data with its scale. Rating takes
+// precedence over RatingPercent, which is returned as is for the caller to
+// convert with the table of its scale.
+func ReadRating(jpgData []byte) (Rating, error) {
+	jmp := jpegstructure.NewJpegMediaParser()
+	intfc, err := jmp.ParseBytes(jpgData)
+	if err != nil {
+		return Rating{}, fmt.Errorf("Error parsing JPEG file: %v", err)
+	}
+
+	rootIfd, _, err := intfc.(*jpegstructure.SegmentList).Exif()
+	if err != nil {
+		return Rating{}, fmt.Errorf("No EXIF data found")
+	}
+
+	if stars, found, err := readShort(rootIfd, tagRating); err != nil {
+		return Rating{}, fmt.Errorf("Error parsing EXIF rating: %v", err)
+	} else if found {
+		if stars > 5 {
+			return Rating{}, fmt.Errorf("Invalid EXIF rating: %d", stars)
+		}
+		return Rating{Stars: stars, Scale: rating.ScaleStars}, nil
+	}
+
+	if percent, found, err := readShort(rootIfd, tagRatingPercent); err != nil {
+		return Rating{}, fmt.Errorf("Error parsing EXIF rating percent: %v", err)
+	} else if found {
+		return Rating{Scale: rating.ScaleExifPercent, Percent: percent}, nil
+	}
+
+	return Rating{}, fmt.Errorf("No rating found in EXIF data")
+}
+
+// readShort reads a single SHORT tag of an IFD
+func readShort(ifd *exif.Ifd, tagID uint16) (int, bool, error) {
+	entries, err := ifd.FindTagWithId(tagID)
+	if err != nil {
+		if errors.Is(err, exif.ErrTagNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	value, err := entries[0].Value()
+	if err != nil {
+		return 0, false, err
+	}
+	shorts, ok := value.([]uint16)
+	if !ok || len(shorts) == 0 {
+		return 0, false, fmt.Errorf("unexpected value %v", value)
+	}
+	return int(shorts[0]), true, nil
+}
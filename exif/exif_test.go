@@ -0,0 +1,70 @@
+package exif
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/frommie/rawmanager/rating"
+	"github.com/frommie/rawmanager/testutils"
+)
+
+func TestGetRatingFromFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    map[string]uint16
+		want    int
+		wantErr bool
+	}{
+		{name: "Rating", tags: map[string]uint16{"Rating": 4}, want: 4},
+		{name: "Rating percent", tags: map[string]uint16{"RatingPercent": 1}, want: 1},
+		{name: "Rating percent 4 stars", tags: map[string]uint16{"RatingPercent": 75}, want: 4},
+		{name: "Rating percent 5 stars", tags: map[string]uint16{"RatingPercent": 99}, want: 5},
+		{name: "Invalid rating percent", tags: map[string]uint16{"RatingPercent": 150}, wantErr: true},
+		{name: "Rating wins over percent", tags: map[string]uint16{"Rating": 2, "RatingPercent": 99}, want: 2},
+		{name: "Unrated", tags: map[string]uint16{"Rating": 0}, want: 0},
+		{name: "Invalid rating", tags: map[string]uint16{"Rating": 9}, wantErr: true},
+		{name: "No rating", tags: map[string]uint16{"Orientation": 1}, wantErr: true},
+		{name: "No EXIF", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jpgPath := filepath.Join(t.TempDir(), "test.JPG")
+			var err error
+			if tt.tags == nil {
+				err = testutils.CreateEmptyJPEG(t, jpgPath)
+			} else {
+				err = testutils.CreateTestJPEGWithExifRating(t, jpgPath, tt.tags)
+			}
+			if err != nil {
+				t.Fatalf("Setup failed: %v", err)
+			}
+
+			got, err := GetRatingFromFile(jpgPath)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetRatingFromFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("GetRatingFromFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadRatingScale(t *testing.T) {
+	jpgPath := filepath.Join(t.TempDir(), "test.JPG")
+	if err := testutils.CreateTestJPEGWithExifRating(t, jpgPath, map[string]uint16{"RatingPercent": 50}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	r, err := ReadRatingFromFile(jpgPath)
+	if err != nil {
+		t.Fatalf("ReadRatingFromFile() error = %v", err)
+	}
+	if r.Scale != "exif_percent" || r.Percent != 50 {
+		t.Errorf("ReadRatingFromFile() = %+v, want 50%% on the exif_percent scale", r)
+	}
+	if stars, err := r.StarsIn(rating.Windows); err != nil || stars != 3 {
+		t.Errorf("StarsIn() = %d, %v, want 3 stars", stars, err)
+	}
+}
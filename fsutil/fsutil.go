@@ -0,0 +1,65 @@
+// Package fsutil provides the file system helpers shared by the packages
+// that write into the library: atomic writes and their temporary files.
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TempPattern names the temporary files of atomic writes, leftovers of
+// interrupted runs are recognized by it
+const TempPattern = ".rawmanager-*.tmp"
+
+// IsTemp reports whether name is a temporary file of an atomic write
+func IsTemp(name string) bool {
+	matched, _ := filepath.Match(TempPattern, filepath.Base(name))
+	return matched
+}
+
+// WriteFile atomically replaces path with data. The data is written to a
+// uniquely named temporary file in the same directory, synced and renamed,
+// so path always holds either its old or its new content.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, TempPattern)
+	if err != nil {
+		return fmt.Errorf("Error creating temporary file for %s: %v", path, err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error writing temporary file for %s: %v", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error syncing temporary file for %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error closing temporary file for %s: %v", path, err)
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error setting permissions of %s: %v", path, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error replacing %s: %v", path, err)
+	}
+	SyncDir(dir)
+	return nil
+}
+
+// SyncDir flushes the entries of a directory to disk, e.g. after a rename
+func SyncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,54 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.xmp")
+	if err := os.WriteFile(path, []byte("OLD"), 0600); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	if err := WriteFile(path, []byte("NEW"), 0640); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "NEW" {
+		t.Errorf("Content = %q (%v), want NEW", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Mode = %v (%v), want 0640", info.Mode().Perm(), err)
+	}
+
+	// No temporary file may be left behind
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Directory holds %d files, want 1", len(entries))
+	}
+}
+
+func TestIsTemp(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: ".rawmanager-123456.tmp", want: true},
+		{name: "/lib/2024/.rawmanager-1.tmp", want: true},
+		{name: "rawmanager-1.tmp", want: false},
+		{name: "img1_temp.jpg", want: false},
+		{name: "img1.JPG", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := IsTemp(tt.name); got != tt.want {
+			t.Errorf("IsTemp(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
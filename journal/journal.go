@@ -0,0 +1,274 @@
+// Package journal records every destructive step of a run in an
+// append-only file so the run can be undone later.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/frommie/rawmanager/fsutil"
+	"github.com/frommie/rawmanager/trash"
+)
+
+// DefaultDir is the journal folder relative to the library root
+const DefaultDir = ".rawmanager/journal"
+
+type Op string
+
+const (
+	// OpDelete means the file was removed, Backup is where its bytes went
+	OpDelete Op = "delete"
+
+	// OpOverwrite means the file was rewritten, Backup holds the original bytes
+	OpOverwrite Op = "overwrite"
+
+	// OpMove means the file was moved, Backup is its new location
+	OpMove Op = "move"
+
+	// OpCreate means the file was created, undo removes it
+	OpCreate Op = "create"
+)
+
+// Entry is a single destructive step
+type Entry struct {
+	Time    time.Time   `json:"time"`
+	Op      Op          `json:"op"`
+	Path    string      `json:"path"`
+	Backup  string      `json:"backup,omitempty"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+}
+
+// Journal is the journal of a single run
+type Journal struct {
+	dir     string
+	runID   string
+	file    *os.File
+	records int
+}
+
+// Dir returns the journal folder of the library at rootDir
+func Dir(rootDir string) string {
+	return filepath.Join(rootDir, DefaultDir)
+}
+
+// Open prepares the journal of a run. The file is created on the first record.
+func Open(dir string, runID string) *Journal {
+	return &Journal{dir: dir, runID: runID}
+}
+
+// Path returns the path of the journal file
+func (j *Journal) Path() string {
+	return filepath.Join(j.dir, j.runID+".jsonl")
+}
+
+// Empty reports whether nothing has been recorded yet
+func (j *Journal) Empty() bool {
+	return j.records == 0
+}
+
+// Record appends an entry and syncs it to disk
+func (j *Journal) Record(e Entry) error {
+	if j.file == nil {
+		if err := os.MkdirAll(j.dir, 0755); err != nil {
+			return fmt.Errorf("Error creating journal directory: %v", err)
+		}
+		file, err := os.OpenFile(j.Path(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("Error opening journal: %v", err)
+		}
+		j.file = file
+		fsutil.SyncDir(j.dir)
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("Error serializing journal entry: %v", err)
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("Error writing journal: %v", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("Error syncing journal: %v", err)
+	}
+	j.records++
+	return nil
+}
+
+// backupPath returns a free location for a file in the run's backup folder.
+// A file backed up twice in a run gets a numbered suffix.
+func (j *Journal) backupPath(path string, rootDir string) string {
+	rel, err := filepath.Rel(rootDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(path)
+	}
+	backup := filepath.Join(j.dir, j.runID, rel)
+	candidate := backup
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s.%d", backup, i)
+	}
+}
+
+// Backup copies the file into the run's backup folder before it is overwritten
+func (j *Journal) Backup(path string, rootDir string) (string, error) {
+	backup := j.backupPath(path, rootDir)
+	if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+		return "", fmt.Errorf("Error creating backup directory: %v", err)
+	}
+	if err := trash.CopyFile(path, backup); err != nil {
+		return "", fmt.Errorf("Error backing up %s: %v", path, err)
+	}
+	return backup, nil
+}
+
+// Close closes the journal file, a later record reopens it
+func (j *Journal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// Load reads all entries of a journal file
+func Load(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening journal: %v", err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			// A crash can leave a truncated last line
+			break
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading journal: %v", err)
+	}
+	return entries, nil
+}
+
+// Undo replays a journal backwards and restores all files to their original
+// paths and timestamps. Entries that cannot be restored are returned as errors
+// while the remaining entries are still processed.
+func Undo(path string) (int, []error) {
+	entries, err := Load(path)
+	if err != nil {
+		return 0, []error{err}
+	}
+
+	restored := 0
+	var errs []error
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := undoEntry(entries[i]); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		restored++
+	}
+	return restored, errs
+}
+
+// undoEntry restores a single file
+func undoEntry(e Entry) error {
+	if e.Op == OpCreate {
+		if err := os.Remove(e.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Error removing %s: %v", e.Path, err)
+		}
+		return nil
+	}
+	if e.Backup == "" {
+		if e.Op == OpOverwrite {
+			return fmt.Errorf("Cannot restore %s: no backup of the original was kept", e.Path)
+		}
+		return fmt.Errorf("Cannot restore %s: it was deleted permanently", e.Path)
+	}
+	if _, err := os.Stat(e.Backup); err != nil {
+		// Entries are written ahead, a crash can stop before the file moved
+		if e.Op != OpOverwrite {
+			if _, err := os.Lstat(e.Path); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("Cannot restore %s: backup %s is missing", e.Path, e.Backup)
+	}
+
+	switch e.Op {
+	case OpDelete, OpMove:
+		if err := trash.Restore(e.Backup, e.Path); err != nil {
+			return err
+		}
+	case OpOverwrite:
+		if err := trash.ReplaceFile(e.Backup, e.Path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Invalid journal operation %q for %s", e.Op, e.Path)
+	}
+
+	if e.Mode != 0 {
+		os.Chmod(e.Path, e.Mode.Perm())
+	}
+	if !e.ModTime.IsZero() {
+		if err := os.Chtimes(e.Path, e.ModTime, e.ModTime); err != nil {
+			return fmt.Errorf("Error restoring timestamps of %s: %v", e.Path, err)
+		}
+	}
+	return nil
+}
+
+// Purge removes journals and their backups older than the given age
+// and returns the number of removed runs
+func Purge(dir string, olderThan time.Duration) (int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Error reading journal directory %s: %v", dir, err)
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	purged := 0
+	for _, file := range files {
+		runID, ok := strings.CutSuffix(file.Name(), ".jsonl")
+		if !ok {
+			continue
+		}
+		created, err := time.ParseInLocation(trash.RunIDFormat, runID, time.Local)
+		if err != nil || created.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, runID)); err != nil {
+			return purged, fmt.Errorf("Error purging backups of %s: %v", runID, err)
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+			return purged, fmt.Errorf("Error purging journal %s: %v", runID, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,104 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	j := Open(dir, "20240504-120000")
+	if !j.Empty() {
+		t.Error("New journal should be empty")
+	}
+
+	for _, path := range []string{"a.RAF", "b.RAF"} {
+		if err := j.Record(Entry{Op: OpDelete, Path: path}); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Simulate a crash while writing the last line
+	file, err := os.OpenFile(j.Path(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	file.WriteString(`{"op":"del`)
+	file.Close()
+
+	entries, err := Load(j.Path())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(entries) != 2 || entries[0].Path != "a.RAF" || entries[1].Path != "b.RAF" {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	rootDir := t.TempDir()
+	j := Open(Dir(rootDir), "20240504-120000")
+	modTime := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+
+	// Deleted file that was moved into a quarantine
+	rawPath := filepath.Join(rootDir, "raw", "test.RAF")
+	rawBackup := filepath.Join(rootDir, ".rawmanager", "quarantine", "test.RAF")
+	if err := os.MkdirAll(filepath.Dir(rawBackup), 0755); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	if err := os.WriteFile(rawBackup, []byte("RAW"), 0644); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// Overwritten file with a backup of the original bytes
+	jpgPath := filepath.Join(rootDir, "test.JPG")
+	if err := os.WriteFile(jpgPath, []byte("ORIGINAL"), 0644); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	jpgBackup, err := j.Backup(jpgPath, rootDir)
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	if err := os.WriteFile(jpgPath, []byte("SMALL"), 0644); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	entries := []Entry{
+		{Op: OpOverwrite, Path: jpgPath, Backup: jpgBackup, ModTime: modTime, Mode: 0644},
+		{Op: OpDelete, Path: rawPath, Backup: rawBackup, ModTime: modTime, Mode: 0644},
+		{Op: OpDelete, Path: filepath.Join(rootDir, "gone.RAF"), ModTime: modTime},
+		// Written ahead of a deletion that never happened
+		{Op: OpDelete, Path: jpgPath, Backup: filepath.Join(rootDir, "missing.JPG"), ModTime: modTime},
+	}
+	for _, e := range entries {
+		if err := j.Record(e); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+	j.Close()
+
+	restored, errs := Undo(j.Path())
+	if restored != 3 {
+		t.Errorf("Undo() restored %d files, want 3", restored)
+	}
+	if len(errs) != 1 {
+		t.Errorf("Undo() errors = %v, want 1 for the permanently deleted file", errs)
+	}
+
+	for path, want := range map[string]string{rawPath: "RAW", jpgPath: "ORIGINAL"} {
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q (%v), want %q", path, data, err, want)
+			continue
+		}
+		info, _ := os.Stat(path)
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("%s modified %v, want %v", path, info.ModTime(), modTime)
+		}
+	}
+}
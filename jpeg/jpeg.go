@@ -6,6 +6,8 @@ import (
 	"github.com/disintegration/imaging"
 	"github.com/dsoprea/go-jpeg-image-structure/v2"
 	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/fsutil"
+	"github.com/frommie/rawmanager/source"
 	"github.com/frommie/rawmanager/xmp"
 	"math"
 	"os"
@@ -19,62 +21,62 @@ const (
 
 	// app1MarkerId is the marker for APP1 segments in JPEG files (0xE1)
 	app1MarkerId = 0xE1
+
+	// legacyTempSuffix ends the temporary files of older versions
+	legacyTempSuffix = "_temp.jpg"
 )
 
-// GetRatingFromFile reads the rating from a JPEG file
+// GetRatingFromFile reads the rating of a single JPEG file from the rating
+// sources selected by the XMP mode
 func GetRatingFromFile(jpgPath string, cfg *config.Config) (int, error) {
-	switch cfg.Xmp.Mode {
-	case config.XmpModeEmbedded:
-		// Read embedded XMP data from JPEG
-		file, err := os.Open(jpgPath)
-		if err != nil {
-			return 0, err
-		}
-		defer file.Close()
-
-		xmpData, err := xmp.ExtractXmpData(file)
-		if err != nil {
-			return 0, err
-		}
-
-		return xmp.GetRating(xmpData)
-
-	case config.XmpModeSeparate:
-		// Read separate .xmp file
-		xmpPath := jpgPath[:len(jpgPath)-len(filepath.Ext(jpgPath))] + ".xmp"
-		return xmp.GetRatingFromFile(xmpPath)
-
-	case config.XmpModeSeparateExt:
-		// Read .jpg.xmp file
-		xmpPath := jpgPath + ".xmp"
-		return xmp.GetRatingFromFile(xmpPath)
+	sources, err := source.NewChain(cfg)
+	if err != nil {
+		return 0, err
+	}
+	meta, err := GetMetadataFromFile(jpgPath, sources)
+	if err != nil {
+		return 0, err
+	}
+	if !meta.Rated {
+		return 0, fmt.Errorf("No rating found in XMP data")
+	}
+	return meta.Rating, nil
+}
 
-	default:
-		return 0, fmt.Errorf("Invalid XMP mode: %s", cfg.Xmp.Mode)
+// GetMetadataFromFile reads rating, label, keywords and pick flag of a JPEG
+// file from a chain of rating sources. Sources such as a Lightroom catalog
+// are read when the chain is created, so callers reuse one chain for many
+// files. The RAW is unknown, so its sidecar is not consulted.
+func GetMetadataFromFile(jpgPath string, sources *source.Chain) (*xmp.Metadata, error) {
+	meta, conflict, err := sources.Lookup(source.Pair{Jpeg: jpgPath})
+	if err == nil && meta == nil {
+		return nil, fmt.Errorf("Conflicting ratings: %s", conflict)
 	}
+	return meta, err
 }
 
-// ResizeWithXMP resizes a JPEG image while preserving XMP and EXIF metadata
+// ResizeWithXMP resizes a JPEG image while preserving XMP and EXIF metadata.
+// The result is written to a temporary file and swapped in atomically.
 func ResizeWithXMP(jpgPath string, config *config.Config, verbose bool) error {
 	// Extract metadata from original image
-	exifSegment, xmpSegment, err := extractMetadata(jpgPath)
+	exifSegment, xmpSegments, err := extractMetadata(jpgPath)
 	if err != nil {
 		return err
 	}
 
 	// Process and resize the image
-	newWidth, newHeight, err := resizeImage(jpgPath, config, verbose)
+	resized, newWidth, newHeight, err := resizeImage(jpgPath, config, verbose)
 	if err != nil {
 		return err
 	}
 
 	// If no resize was needed, return early
-	if newWidth == 0 && newHeight == 0 {
+	if resized == nil {
 		return nil
 	}
 
 	// Combine resized image with original metadata
-	if err := combineImageAndMetadata(jpgPath, exifSegment, xmpSegment, config); err != nil {
+	if err := combineImageAndMetadata(jpgPath, resized, exifSegment, xmpSegments); err != nil {
 		return err
 	}
 
@@ -85,8 +87,46 @@ func ResizeWithXMP(jpgPath string, config *config.Config, verbose bool) error {
 	return nil
 }
 
-// extractMetadata reads EXIF and XMP segments from the original JPEG
-func extractMetadata(jpgPath string) (*jpegstructure.Segment, *jpegstructure.Segment, error) {
+// FindTempFiles lists the temporary files left behind by an interrupted
+// ResizeWithXMP in dir. Legacy lists the <name>_temp.jpg files written by
+// older versions next to a JPEG <name> with one of exts. They may as well
+// be real images and are only reported.
+func FindTempFiles(dir string, exts []string) (temps []string, legacy []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := map[string]bool{}
+	for _, entry := range entries {
+		names[strings.ToLower(entry.Name())] = true
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if fsutil.IsTemp(name) {
+			temps = append(temps, filepath.Join(dir, name))
+			continue
+		}
+		base, ok := strings.CutSuffix(strings.ToLower(name), legacyTempSuffix)
+		if !ok {
+			continue
+		}
+		for _, ext := range exts {
+			if names[base+strings.ToLower(ext)] {
+				legacy = append(legacy, filepath.Join(dir, name))
+				break
+			}
+		}
+	}
+	return temps, legacy, nil
+}
+
+// extractMetadata reads the EXIF segment and the XMP segments from the
+// original JPEG, the standard packet followed by any extended XMP chunks
+func extractMetadata(jpgPath string) (*jpegstructure.Segment, []*jpegstructure.Segment, error) {
 	data, err := os.ReadFile(jpgPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error reading file: %v", err)
@@ -100,25 +140,32 @@ func extractMetadata(jpgPath string) (*jpegstructure.Segment, *jpegstructure.Seg
 
 	sl := intfc.(*jpegstructure.SegmentList)
 	var exifSegment, xmpSegment *jpegstructure.Segment
+	var extendedSegments []*jpegstructure.Segment
 
 	for _, segment := range sl.Segments() {
 		if segment.MarkerId == app1MarkerId {
 			if bytes.HasPrefix(segment.Data, []byte(xmpNamespace)) {
 				xmpSegment = segment
+			} else if xmp.IsExtendedSegment(segment.Data) {
+				extendedSegments = append(extendedSegments, segment)
 			} else {
 				exifSegment = segment
 			}
 		}
 	}
 
-	return exifSegment, xmpSegment, nil
+	if xmpSegment == nil {
+		return exifSegment, nil, nil
+	}
+	return exifSegment, append([]*jpegstructure.Segment{xmpSegment}, extendedSegments...), nil
 }
 
-// resizeImage performs the actual image resizing if needed
-func resizeImage(jpgPath string, config *config.Config, verbose bool) (int, int, error) {
+// resizeImage performs the actual image resizing if needed and returns the
+// encoded image, or nil if the image is already small enough
+func resizeImage(jpgPath string, config *config.Config, verbose bool) ([]byte, int, int, error) {
 	img, err := imaging.Open(jpgPath)
 	if err != nil {
-		return 0, 0, fmt.Errorf("error opening image: %v", err)
+		return nil, 0, 0, fmt.Errorf("error opening image: %v", err)
 	}
 
 	bounds := img.Bounds()
@@ -131,7 +178,7 @@ func resizeImage(jpgPath string, config *config.Config, verbose bool) (int, int,
 			fmt.Printf("Image %s is already small enough (%.1f MP)\n",
 				jpgPath, currentMP)
 		}
-		return 0, 0, nil
+		return nil, 0, 0, nil
 	}
 
 	ratio := math.Sqrt(config.Process.TargetMegapixels / currentMP)
@@ -140,29 +187,20 @@ func resizeImage(jpgPath string, config *config.Config, verbose bool) (int, int,
 
 	resized := imaging.Resize(img, newWidth, newHeight, imaging.Lanczos)
 
-	tempPath := strings.TrimSuffix(jpgPath, config.Files.JpegExtension) + "_temp.jpg"
-	if err := imaging.Save(resized, tempPath, imaging.JPEGQuality(config.Process.JpegQuality)); err != nil {
-		return 0, 0, fmt.Errorf("error saving temporary image: %v", err)
+	var buffer bytes.Buffer
+	if err := imaging.Encode(&buffer, resized, imaging.JPEG, imaging.JPEGQuality(config.Process.JpegQuality)); err != nil {
+		return nil, 0, 0, fmt.Errorf("error encoding resized image: %v", err)
 	}
-	defer os.Remove(tempPath)
 
-	return newWidth, newHeight, nil
+	return buffer.Bytes(), newWidth, newHeight, nil
 }
 
 // combineImageAndMetadata combines the resized image with the original metadata
-func combineImageAndMetadata(jpgPath string, exifSegment, xmpSegment *jpegstructure.Segment, config *config.Config) error {
-	tempPath := strings.TrimSuffix(jpgPath, config.Files.JpegExtension) + "_temp.jpg"
-
-	// Read temporary file
-	newData, err := os.ReadFile(tempPath)
-	if err != nil {
-		return fmt.Errorf("error reading temporary image: %v", err)
-	}
-
+func combineImageAndMetadata(jpgPath string, newData []byte, exifSegment *jpegstructure.Segment, xmpSegments []*jpegstructure.Segment) error {
 	jmp := jpegstructure.NewJpegMediaParser()
 	newIntfc, err := jmp.ParseBytes(newData)
 	if err != nil {
-		return fmt.Errorf("error parsing temporary image: %v", err)
+		return fmt.Errorf("error parsing resized image: %v", err)
 	}
 
 	newSl := newIntfc.(*jpegstructure.SegmentList)
@@ -183,9 +221,7 @@ func combineImageAndMetadata(jpgPath string, exifSegment, xmpSegment *jpegstruct
 	if exifSegment != nil {
 		newSegments = append(newSegments, exifSegment)
 	}
-	if xmpSegment != nil {
-		newSegments = append(newSegments, xmpSegment)
-	}
+	newSegments = append(newSegments, xmpSegments...)
 	newSegments = append(newSegments, segments[insertPos:]...)
 
 	// Write final file
@@ -195,9 +231,9 @@ func combineImageAndMetadata(jpgPath string, exifSegment, xmpSegment *jpegstruct
 		return fmt.Errorf("error serializing JPEG data: %v", err)
 	}
 
-	if err := os.WriteFile(jpgPath, buffer.Bytes(), 0644); err != nil {
-		return fmt.Errorf("error saving final JPEG: %v", err)
+	info, err := os.Stat(jpgPath)
+	if err != nil {
+		return fmt.Errorf("error reading file info: %v", err)
 	}
-
-	return nil
+	return fsutil.WriteFile(jpgPath, buffer.Bytes(), info.Mode().Perm())
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/disintegration/imaging"
 	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/source"
 	"github.com/frommie/rawmanager/testutils"
 )
 
@@ -37,6 +38,44 @@ func TestGetRatingFromFile(t *testing.T) {
 	}
 }
 
+func TestGetRatingFromFileExifFallback(t *testing.T) {
+	tmpDir := t.TempDir()
+	exifPath := filepath.Join(tmpDir, "exif.jpg")
+	if err := testutils.CreateTestJPEGWithExifRating(t, exifPath, map[string]uint16{"Rating": 2}); err != nil {
+		t.Fatalf("Failed to create test JPEG: %v", err)
+	}
+	xmpPath := filepath.Join(tmpDir, "xmp.jpg")
+	if err := testutils.CreateTestJPEGWithEmbeddedXMP(t, xmpPath, 4); err != nil {
+		t.Fatalf("Failed to create test JPEG: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		mode    config.XmpMode
+		want    int
+		wantErr bool
+	}{
+		{name: "Embedded without XMP", path: exifPath, mode: config.XmpModeEmbedded, wantErr: true},
+		{name: "Fallback to EXIF", path: exifPath, mode: config.XmpModeEmbeddedExif, want: 2},
+		{name: "XMP preferred", path: xmpPath, mode: config.XmpModeEmbeddedExif, want: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Xmp: config.XmpConfig{Mode: tt.mode}}
+			got, err := GetRatingFromFile(tt.path, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetRatingFromFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("GetRatingFromFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestResizeWithXMP(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -78,8 +117,8 @@ func TestResizeWithXMP(t *testing.T) {
 					JpegQuality:      95,
 				},
 				Files: config.FileConfig{
-					JpegExtension: ".JPG",
-					RawExtension:  ".RAF",
+					JpegExtension: config.Extensions{".JPG"},
+					RawExtension:  config.Extensions{".RAF"},
 				},
 			}
 
@@ -92,6 +131,108 @@ func TestResizeWithXMP(t *testing.T) {
 	}
 }
 
+func TestResizeWithExtendedXMP(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "test.JPG")
+	extended := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <dc:subject><rdf:Bag><rdf:li>print</rdf:li></rdf:Bag></dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+	if err := testutils.CreateTestJPEGWithExtendedXMP(t, jpgPath, 2, extended, 64); err != nil {
+		t.Fatalf("Failed to create test JPEG: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Process.TargetMegapixels = 0.001
+	if err := ResizeWithXMP(jpgPath, cfg, false); err != nil {
+		t.Fatalf("ResizeWithXMP() error = %v", err)
+	}
+
+	// The extension segments are carried into the resized JPEG
+	sources, err := source.NewChain(cfg)
+	if err != nil {
+		t.Fatalf("NewChain() error = %v", err)
+	}
+	meta, err := GetMetadataFromFile(jpgPath, sources)
+	if err != nil {
+		t.Fatalf("GetMetadataFromFile() error = %v", err)
+	}
+	if meta.Rating != 2 || !meta.HasKeyword("print") {
+		t.Errorf("Metadata = %+v, want rating 2 and keyword print", meta)
+	}
+}
+
+func TestResizeWithXMPReplacesAtomically(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "test.JPG")
+	if err := createTestJPEGWithRating(t, jpgPath, 4); err != nil {
+		t.Fatalf("Error during test setup: %v", err)
+	}
+	// A real file with the old temporary name must survive
+	otherPath := filepath.Join(tmpDir, "test_temp.jpg")
+	if err := createEmptyJPEG(otherPath); err != nil {
+		t.Fatalf("Error during test setup: %v", err)
+	}
+
+	cfg := &config.Config{
+		Xmp: config.XmpConfig{Mode: config.XmpModeEmbedded},
+		Process: config.ProcessConfig{
+			TargetMegapixels: 0.0025,
+			JpegQuality:      95,
+		},
+	}
+	if err := ResizeWithXMP(jpgPath, cfg, false); err != nil {
+		t.Fatalf("ResizeWithXMP() error = %v", err)
+	}
+
+	img, err := imaging.Open(jpgPath)
+	if err != nil {
+		t.Fatalf("Error opening resized image: %v", err)
+	}
+	if img.Bounds().Dx() != 50 || img.Bounds().Dy() != 50 {
+		t.Errorf("Resized to %v, want 50x50", img.Bounds())
+	}
+	if rating, err := GetRatingFromFile(jpgPath, cfg); err != nil || rating != 4 {
+		t.Errorf("Rating after resize = %d (%v), want 4", rating, err)
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Unexpected files left behind: %v", entries)
+	}
+}
+
+func TestFindTempFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{".rawmanager-123.tmp", "test.JPG", "test_temp.jpg", "party_temp.jpg"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("data"), 0644); err != nil {
+			t.Fatalf("Error during test setup: %v", err)
+		}
+	}
+
+	temps, legacy, err := FindTempFiles(tmpDir, []string{".JPG"})
+	if err != nil {
+		t.Fatalf("FindTempFiles() error = %v", err)
+	}
+	if len(temps) != 1 || filepath.Base(temps[0]) != ".rawmanager-123.tmp" {
+		t.Errorf("FindTempFiles() temps = %v", temps)
+	}
+	// party_temp.jpg has no original next to it
+	if len(legacy) != 1 || filepath.Base(legacy[0]) != "test_temp.jpg" {
+		t.Errorf("FindTempFiles() legacy = %v", legacy)
+	}
+	// Nothing is removed
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 4 {
+		t.Errorf("Files were removed: %v", entries)
+	}
+}
+
 // Help functions for tests
 func createEmptyJPEG(path string) error {
 	img := imaging.New(100, 100, color.White)
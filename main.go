@@ -2,34 +2,56 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/journal"
+	"github.com/frommie/rawmanager/plan"
 	"github.com/frommie/rawmanager/processor"
+	"github.com/frommie/rawmanager/trash"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
+	args := os.Args[1:]
+	command := "process"
+	if len(args) > 0 {
+		switch args[0] {
+		case "plan", "apply", "purge", "undo", "restore":
+			command = args[0]
+			args = args[1:]
+		}
+	}
+
 	var (
-		photosDir  string
 		configPath string
+		planPath   string
+		olderThan  string
+		restoreAll bool
+		full       bool
 		verbose    bool
 	)
 
-	flag.StringVar(&configPath, "config", "", "Path to YAML configuration file")
-	flag.BoolVar(&verbose, "v", false, "Verbose mode (shows detailed output)")
-	flag.Parse()
-
-	// Check if a path was passed as an argument
-	args := flag.Args()
-	if len(args) > 0 {
-		photosDir = args[0]
-	} else {
-		var err error
-		photosDir, err = os.Getwd()
-		if err != nil {
-			log.Fatal("Error determining current directory:", err)
-		}
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "Path to YAML configuration file")
+	flags.BoolVar(&verbose, "v", false, "Verbose mode (shows detailed output)")
+	if command == "process" || command == "plan" {
+		flags.BoolVar(&full, "full", false, "Evaluate all pairs, including those unchanged since the last run")
+	}
+	if command == "plan" {
+		flags.StringVar(&planPath, "o", "plan.json", "Path of the plan file to write")
+	}
+	if command == "purge" {
+		flags.StringVar(&olderThan, "older-than", "30d", "Purge quarantine batches older than this age (e.g. 30d, 12h)")
 	}
+	if command == "restore" {
+		flags.BoolVar(&restoreAll, "all", false, "Restore all archived originals regardless of their rating")
+	}
+	flags.Parse(args)
 
 	// Load configuration
 	var cfg *config.Config
@@ -42,14 +64,163 @@ func main() {
 	} else {
 		cfg = config.NewDefaultConfig()
 	}
+	if command == "restore" {
+		restoreOriginals(cfg, flags.Args(), restoreAll, verbose)
+		return
+	}
+
+	if command == "undo" {
+		if flags.NArg() < 1 {
+			log.Fatal("Usage: rawmanager undo [-config path] <run-id> [directory]")
+		}
+		runID := flags.Arg(0)
+		photosDir := "."
+		if flags.NArg() > 1 {
+			photosDir = flags.Arg(1)
+		}
+		restored, errs := journal.Undo(journal.Open(journal.Dir(photosDir), runID).Path())
+		for _, err := range errs {
+			log.Println(err)
+		}
+		fmt.Printf("Restored %d files of run %s\n", restored, runID)
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if command == "apply" {
+		if flags.NArg() != 1 {
+			log.Fatal("Usage: rawmanager apply [-config path] [-v] plan.json")
+		}
+		pl, err := plan.Load(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		proc := processor.NewImageProcessor(pl.RootDir, cfg, verbose)
+		if err := proc.Apply(pl); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("\n%s", proc.Summary())
+		printUndoHint(proc)
+		return
+	}
+
+	// Check if a path was passed as an argument
+	var photosDir string
+	if flags.NArg() > 0 {
+		photosDir = flags.Arg(0)
+	} else {
+		var err error
+		photosDir, err = os.Getwd()
+		if err != nil {
+			log.Fatal("Error determining current directory:", err)
+		}
+	}
 
-	proc := &processor.ImageProcessor{
-		RootDir: photosDir,
-		Config:  cfg,
-		Verbose: verbose,
+	if command == "purge" {
+		age, err := parseAge(olderThan)
+		if err != nil {
+			log.Fatal(err)
+		}
+		purged, err := trash.Purge(trash.QuarantineDir(cfg, photosDir), age)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runs, err := journal.Purge(journal.Dir(photosDir), age)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Purged %d quarantine batches and %d journals\n", purged, runs)
+		return
+	}
+
+	proc := processor.NewImageProcessor(photosDir, cfg, verbose)
+	proc.Full = full
+
+	if command == "plan" {
+		// Store absolute paths so the plan can be applied from anywhere
+		absDir, err := filepath.Abs(photosDir)
+		if err != nil {
+			log.Fatal("Error resolving directory:", err)
+		}
+		proc.RootDir = absDir
+
+		pl, err := proc.Plan(true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pl.Save(planPath); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("\n%s", pl.Summary())
+		fmt.Printf("Plan with %d actions written to %s\n", len(pl.Entries), planPath)
+		return
 	}
 
 	if err := proc.Process(); err != nil {
 		log.Fatal(err)
 	}
+	fmt.Printf("\n%s", proc.Summary())
+	printUndoHint(proc)
+}
+
+// restoreOriginals restores archived originals. The first argument may name
+// the library (default: current directory), further arguments name single
+// JPEGs whose originals are restored unconditionally. Without files all
+// JPEGs that lost their compress rating (or all with -all) are restored.
+func restoreOriginals(cfg *config.Config, args []string, all bool, verbose bool) {
+	photosDir := "."
+	if len(args) > 0 {
+		if info, err := os.Stat(args[0]); err == nil && info.IsDir() {
+			photosDir = args[0]
+			args = args[1:]
+		}
+	}
+	proc := processor.NewImageProcessor(photosDir, cfg, verbose)
+
+	if len(args) == 0 {
+		restored, err := proc.RestoreOriginals(all)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Restored %d originals\n", restored)
+		return
+	}
+
+	failed := false
+	for _, path := range args {
+		if err := proc.RestoreOriginal(path); err != nil {
+			log.Println(err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Restored original of %s\n", path)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// printUndoHint tells the user how to undo the run that just finished
+func printUndoHint(proc *processor.ImageProcessor) {
+	if proc.Journaled() {
+		fmt.Printf("\nRun %s journaled, undo with: rawmanager undo %s %s\n", proc.RunID(), proc.RunID(), proc.RootDir)
+	}
+}
+
+// parseAge parses a duration that additionally accepts days, e.g. "30d"
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("Invalid age: %s", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid age: %s", value)
+	}
+	return age, nil
 }
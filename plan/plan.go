@@ -0,0 +1,598 @@
+// Package plan describes the destructive actions of a run so they can be
+// reviewed, stored as JSON and applied later.
+package plan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/rating"
+)
+
+type Action string
+
+const (
+	// ActionDelete removes the file
+	ActionDelete Action = "delete"
+
+	// ActionCompress resizes the JPEG in place
+	ActionCompress Action = "compress"
+
+	// ActionMove moves the file to Target
+	ActionMove Action = "move"
+
+	// ActionSidecar writes rating, label and keywords of the JPEG into the
+	// RAW sidecar at Target
+	ActionSidecar Action = "sidecar"
+
+	// ActionCleanup removes a leftover temporary file for good, without
+	// backup and outside of the safety limits
+	ActionCleanup Action = "cleanup"
+)
+
+type Kind string
+
+const (
+	// KindRaw marks RAW files
+	KindRaw Kind = "raw"
+
+	// KindJpeg marks JPEG files
+	KindJpeg Kind = "jpeg"
+
+	// KindSidecar marks XMP sidecars of RAW files
+	KindSidecar Kind = "sidecar"
+
+	// KindTemp marks temporary files left behind by an interrupted run
+	KindTemp Kind = "temp"
+)
+
+// Entry is a single planned action on a single file
+type Entry struct {
+	File   string `json:"file"`
+	Kind   Kind   `json:"kind"`
+	Rating int    `json:"rating"`
+	Action Action `json:"action"`
+	Reason string `json:"reason"`
+	Target string `json:"target,omitempty"`
+
+	// Jpeg and Raw are the pair whose metadata decided the action
+	Jpeg string `json:"jpeg,omitempty"`
+	Raw  string `json:"raw,omitempty"`
+
+	// Sources are the other files the pair's rating was read from
+	Sources []Source `json:"sources,omitempty"`
+
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// Source is a rating source file of an entry's pair as it was when planning.
+// Missing records that the file did not exist.
+type Source struct {
+	File    string    `json:"file"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"hash,omitempty"`
+	Missing bool      `json:"missing,omitempty"`
+}
+
+// Skip is a file that was left alone although an action applied to it
+type Skip struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// Conflict is a pair whose rating sources disagree
+type Conflict struct {
+	File       string         `json:"file"`
+	Ratings    map[string]int `json:"ratings"`    // Rating per source
+	Resolution string         `json:"resolution"` // Policy and chosen rating, or "skipped"
+}
+
+// Normalized is a rating converted to stars from a percent-based scale
+type Normalized struct {
+	File    string `json:"file"`
+	Scale   string `json:"scale"`   // Scale of the original rating, e.g. microsoft
+	Percent int    `json:"percent"` // Original rating
+	Rating  int    `json:"rating"`  // Rating in stars
+}
+
+// Stats describes the library as seen while planning
+type Stats struct {
+	// RawFiles counts the RAW files per folder
+	RawFiles map[string]int `json:"rawFiles"`
+
+	// RatingReads and RatingErrors count rating lookups and their failures
+	RatingReads  int `json:"ratingReads"`
+	RatingErrors int `json:"ratingErrors"`
+
+	// Ratings counts the evaluated pairs per rating, -1 being rejected
+	Ratings map[int]int `json:"ratings"`
+
+	// Unchanged counts pairs skipped because they did not change since the last run
+	Unchanged int `json:"unchanged"`
+
+	// Scales counts the evaluated ratings per rating scale they were read in
+	Scales map[string]int `json:"scales"`
+
+	// Extensions counts the JPEG, HEIF and RAW files of the library per extension
+	Extensions map[string]int `json:"extensions"`
+}
+
+type Plan struct {
+	RootDir string    `json:"rootDir"`
+	Created time.Time `json:"created"`
+	Entries []Entry   `json:"entries"`
+	Skipped []Skip    `json:"skipped"`
+	Stats   Stats     `json:"stats"`
+
+	// Conflicts lists the pairs whose rating sources disagree
+	Conflicts []Conflict `json:"conflicts"`
+
+	// Normalized lists the ratings converted from percent-based scales
+	Normalized []Normalized `json:"normalized"`
+
+	// Hash enables SHA-256 fingerprints for new entries
+	Hash bool `json:"-"`
+}
+
+// New creates an empty plan for the given library
+func New(rootDir string, hash bool) *Plan {
+	return &Plan{
+		RootDir:    rootDir,
+		Created:    time.Now(),
+		Entries:    []Entry{},
+		Skipped:    []Skip{},
+		Stats:      Stats{RawFiles: map[string]int{}, Ratings: map[int]int{}, Scales: map[string]int{}, Extensions: map[string]int{}},
+		Conflicts:  []Conflict{},
+		Normalized: []Normalized{},
+		Hash:       hash,
+	}
+}
+
+// Add fingerprints the file and appends an entry for it
+func (p *Plan) Add(file string, kind Kind, rating int, action Action, reason string) error {
+	return p.add(file, kind, rating, action, reason, "")
+}
+
+// AddMove fingerprints the file and appends a move to target
+func (p *Plan) AddMove(file string, kind Kind, rating int, target string, reason string) error {
+	return p.add(file, kind, rating, ActionMove, reason, target)
+}
+
+// AddSidecar fingerprints the JPEG and appends a write of its metadata to
+// the sidecar at target
+func (p *Plan) AddSidecar(file string, rating int, target string, reason string) error {
+	return p.add(file, KindJpeg, rating, ActionSidecar, reason, target)
+}
+
+// add appends an entry unless the file is already planned for the action
+// with the same target
+func (p *Plan) add(file string, kind Kind, rating int, action Action, reason string, target string) error {
+	for _, e := range p.Entries {
+		if e.File == file && e.Action == action && e.Target == target {
+			return nil
+		}
+	}
+
+	size, modTime, hash, err := fingerprint(file, p.Hash)
+	if err != nil {
+		return err
+	}
+
+	p.Entries = append(p.Entries, Entry{
+		File:    file,
+		Kind:    kind,
+		Rating:  rating,
+		Action:  action,
+		Reason:  reason,
+		Target:  target,
+		Size:    size,
+		ModTime: modTime,
+		Hash:    hash,
+	})
+	return nil
+}
+
+// SetPair records the pair whose metadata decided the entries from index on
+// and fingerprints the files its rating was read from
+func (p *Plan) SetPair(from int, jpeg, raw string, sources []string) error {
+	for i := from; i < len(p.Entries); i++ {
+		e := &p.Entries[i]
+		e.Jpeg, e.Raw = jpeg, raw
+		seen := map[string]bool{e.File: true}
+		for _, file := range sources {
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+			source, err := sourceOf(file, e.Hash != "")
+			if err != nil {
+				return err
+			}
+			e.Sources = append(e.Sources, source)
+		}
+	}
+	return nil
+}
+
+// Refresh fingerprints file again in the sources of the entries from index
+// on, after an applied entry changed it
+func (p *Plan) Refresh(from int, file string) error {
+	for i := from; i < len(p.Entries); i++ {
+		for j, source := range p.Entries[i].Sources {
+			if source.File != file {
+				continue
+			}
+			refreshed, err := sourceOf(file, p.Entries[i].Hash != "")
+			if err != nil {
+				return err
+			}
+			p.Entries[i].Sources[j] = refreshed
+		}
+	}
+	return nil
+}
+
+// Has reports whether the file is already planned for the action
+func (p *Plan) Has(file string, action Action) bool {
+	for _, e := range p.Entries {
+		if e.File == file && e.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Skip records a file that is left alone and why
+func (p *Plan) Skip(file string, reason string) {
+	p.Skipped = append(p.Skipped, Skip{File: file, Reason: reason})
+}
+
+// Flag records a pair whose rating sources disagree and how it was resolved
+func (p *Plan) Flag(file string, ratings map[string]int, resolution string) {
+	p.Conflicts = append(p.Conflicts, Conflict{File: file, Ratings: ratings, Resolution: resolution})
+}
+
+// Rated records the scale a rating was read in, ratings of other editors
+// without a scale count as stars. Ratings converted from a percent-based
+// scale are listed with their original value.
+func (p *Plan) Rated(file, scale string, percent, stars int) {
+	if scale == "" {
+		scale = rating.ScaleStars
+	}
+	p.Stats.Scales[scale]++
+	if scale != rating.ScaleStars {
+		p.Normalized = append(p.Normalized, Normalized{File: file, Scale: scale, Percent: percent, Rating: stars})
+	}
+}
+
+// Save writes the plan as indented JSON
+func (p *Plan) Save(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error serializing plan: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Error writing plan: %v", err)
+	}
+	return nil
+}
+
+// Load reads a plan written by Save
+func Load(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading plan: %v", err)
+	}
+
+	var p Plan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("Error parsing plan: %v", err)
+	}
+	for _, e := range p.Entries {
+		switch e.Action {
+		case ActionDelete, ActionCompress, ActionCleanup:
+		case ActionMove, ActionSidecar:
+			if e.Target == "" {
+				return nil, fmt.Errorf("Missing target for %s of %s", e.Action, e.File)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid action %q for %s", e.Action, e.File)
+		}
+	}
+	return &p, nil
+}
+
+// Verify checks that neither the file nor the rating sources of its pair
+// have changed since it was planned
+func (e *Entry) Verify() error {
+	if err := verifyFile(e.File, e.Size, e.ModTime, e.Hash); err != nil {
+		return err
+	}
+	for _, source := range e.Sources {
+		current, err := sourceOf(source.File, source.Hash != "")
+		if err != nil {
+			return err
+		}
+		switch {
+		case source.Missing && !current.Missing:
+			return fmt.Errorf("rating source %s was created since planning", source.File)
+		case !source.Missing && current.Missing:
+			return fmt.Errorf("rating source %s was removed since planning", source.File)
+		case source.Missing:
+			continue
+		}
+		if err := verifyFile(source.File, source.Size, source.ModTime, source.Hash); err != nil {
+			return fmt.Errorf("rating source %v", err)
+		}
+	}
+	return nil
+}
+
+// verifyFile compares a file with its fingerprint from planning
+func verifyFile(file string, plannedSize int64, plannedModTime time.Time, plannedHash string) error {
+	size, modTime, hash, err := fingerprint(file, plannedHash != "")
+	if err != nil {
+		return err
+	}
+	if size != plannedSize {
+		return fmt.Errorf("%s changed since planning (size %d, planned %d)", file, size, plannedSize)
+	}
+	if !modTime.Equal(plannedModTime) {
+		return fmt.Errorf("%s changed since planning (modified %s)", file, modTime.Format(time.RFC3339))
+	}
+	if hash != plannedHash {
+		return fmt.Errorf("%s changed since planning (hash mismatch)", file)
+	}
+	return nil
+}
+
+// CheckLimits checks the plan against the safety limits of a run and
+// returns an error describing every limit that would be crossed
+func (p *Plan) CheckLimits(limits config.LimitsConfig) error {
+	var violations []string
+
+	// Rating read failures
+	if limits.MaxRatingErrorPercent > 0 && p.Stats.RatingReads > 0 {
+		percent := percentOf(p.Stats.RatingErrors, p.Stats.RatingReads)
+		if percent > limits.MaxRatingErrorPercent {
+			violations = append(violations, fmt.Sprintf("%d of %d rating reads failed (%.1f%%, limit %.1f%%)",
+				p.Stats.RatingErrors, p.Stats.RatingReads, percent, limits.MaxRatingErrorPercent))
+		}
+	}
+
+	// Collect RAW deletions and removed bytes
+	rawDeletes := map[string]int{}
+	totalRawDeletes := 0
+	var bytesRemoved int64
+	for _, e := range p.Entries {
+		if e.Action != ActionDelete {
+			continue
+		}
+		bytesRemoved += e.Size
+		if e.Kind == KindRaw {
+			rawDeletes[filepath.Dir(e.File)]++
+			totalRawDeletes++
+		}
+	}
+
+	// Per folder
+	folders := make([]string, 0, len(rawDeletes))
+	for folder := range rawDeletes {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		deletes := rawDeletes[folder]
+		if limits.MaxRawDeletesPerFolder > 0 && deletes > limits.MaxRawDeletesPerFolder {
+			violations = append(violations, fmt.Sprintf("%s: %d RAWs would be deleted (limit %d)",
+				folder, deletes, limits.MaxRawDeletesPerFolder))
+		}
+		if total := p.Stats.RawFiles[folder]; limits.MaxRawDeletePercentPerFolder > 0 && total > 0 {
+			if percent := percentOf(deletes, total); percent > limits.MaxRawDeletePercentPerFolder {
+				violations = append(violations, fmt.Sprintf("%s: %d of %d RAWs would be deleted (%.1f%%, limit %.1f%%)",
+					folder, deletes, total, percent, limits.MaxRawDeletePercentPerFolder))
+			}
+		}
+	}
+
+	// Per run
+	if limits.MaxRawDeletesPerRun > 0 && totalRawDeletes > limits.MaxRawDeletesPerRun {
+		violations = append(violations, fmt.Sprintf("%d RAWs would be deleted in this run (limit %d)",
+			totalRawDeletes, limits.MaxRawDeletesPerRun))
+	}
+	totalRaws := 0
+	for _, count := range p.Stats.RawFiles {
+		totalRaws += count
+	}
+	if limits.MaxRawDeletePercentPerRun > 0 && totalRaws > 0 {
+		if percent := percentOf(totalRawDeletes, totalRaws); percent > limits.MaxRawDeletePercentPerRun {
+			violations = append(violations, fmt.Sprintf("%d of %d RAWs would be deleted in this run (%.1f%%, limit %.1f%%)",
+				totalRawDeletes, totalRaws, percent, limits.MaxRawDeletePercentPerRun))
+		}
+	}
+	if limits.MaxBytesRemoved > 0 && bytesRemoved > limits.MaxBytesRemoved {
+		violations = append(violations, fmt.Sprintf("%d bytes would be removed (limit %d)",
+			bytesRemoved, limits.MaxBytesRemoved))
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("Safety limits exceeded, nothing was deleted:\n  - %s", strings.Join(violations, "\n  - "))
+	}
+	return nil
+}
+
+// RatingName describes a rating for reports, keeping rejected images apart
+// from low-rated ones
+func RatingName(rating int) string {
+	switch rating {
+	case config.RejectedRating:
+		return "rejected"
+	case 0:
+		return "unrated"
+	case 1:
+		return "1 star"
+	default:
+		return fmt.Sprintf("%d stars", rating)
+	}
+}
+
+// Summary describes the ratings found while planning, the planned actions
+// and every skipped file with the reason, e.g. its protection
+func (p *Plan) Summary() string {
+	var b strings.Builder
+
+	ratings := make([]int, 0, len(p.Stats.Ratings))
+	for rating := range p.Stats.Ratings {
+		ratings = append(ratings, rating)
+	}
+	sort.Ints(ratings)
+	if len(ratings) > 0 {
+		b.WriteString("Ratings:\n")
+		for _, rating := range ratings {
+			fmt.Fprintf(&b, "  %-9s %d\n", RatingName(rating)+":", p.Stats.Ratings[rating])
+		}
+	}
+
+	actions := map[Action]int{}
+	rejected := map[Action]int{}
+	for _, e := range p.Entries {
+		actions[e.Action]++
+		if e.Rating == config.RejectedRating {
+			rejected[e.Action]++
+		}
+	}
+	if len(p.Entries) > 0 {
+		b.WriteString("Actions:\n")
+		for _, action := range []Action{ActionDelete, ActionCompress, ActionMove, ActionSidecar, ActionCleanup} {
+			if actions[action] == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "  %-9s %d", string(action)+":", actions[action])
+			if rejected[action] > 0 {
+				fmt.Fprintf(&b, " (%d rejected)", rejected[action])
+			}
+			b.WriteString("\n")
+		}
+	}
+	p.writeExtensions(&b)
+	if len(p.Skipped) > 0 {
+		fmt.Fprintf(&b, "Skipped:   %d\n", len(p.Skipped))
+		for _, skip := range p.Skipped {
+			fmt.Fprintf(&b, "  %s: %s\n", skip.File, skip.Reason)
+		}
+	}
+	if len(p.Conflicts) > 0 {
+		fmt.Fprintf(&b, "Conflicts: %d\n", len(p.Conflicts))
+	}
+	if len(p.Normalized) > 0 {
+		scales := make([]string, 0, len(p.Stats.Scales))
+		for scale := range p.Stats.Scales {
+			scales = append(scales, scale)
+		}
+		sort.Strings(scales)
+		b.WriteString("Rating scales:\n")
+		for _, scale := range scales {
+			fmt.Fprintf(&b, "  %-13s %d\n", scale+":", p.Stats.Scales[scale])
+		}
+	}
+	return b.String()
+}
+
+// writeExtensions lists files and planned actions per extension for
+// libraries with more than one extension. Sidecar writes count for the
+// sidecar's extension.
+func (p *Plan) writeExtensions(b *strings.Builder) {
+	if len(p.Stats.Extensions) < 2 {
+		return
+	}
+	actions := map[string]map[Action]int{}
+	for _, e := range p.Entries {
+		file := e.File
+		if e.Action == ActionSidecar {
+			file = e.Target
+		}
+		ext := strings.ToUpper(filepath.Ext(file))
+		if actions[ext] == nil {
+			actions[ext] = map[Action]int{}
+		}
+		actions[ext][e.Action]++
+	}
+
+	exts := make([]string, 0, len(p.Stats.Extensions)+len(actions))
+	for ext := range p.Stats.Extensions {
+		exts = append(exts, ext)
+	}
+	for ext := range actions {
+		if _, counted := p.Stats.Extensions[ext]; !counted {
+			exts = append(exts, ext)
+		}
+	}
+	sort.Strings(exts)
+
+	b.WriteString("Extensions:\n")
+	for _, ext := range exts {
+		var parts []string
+		if files, counted := p.Stats.Extensions[ext]; counted {
+			parts = append(parts, fmt.Sprintf("%d files", files))
+		}
+		for _, action := range []Action{ActionDelete, ActionCompress, ActionMove, ActionSidecar, ActionCleanup} {
+			if n := actions[ext][action]; n > 0 {
+				parts = append(parts, fmt.Sprintf("%s %d", action, n))
+			}
+		}
+		fmt.Fprintf(b, "  %-9s %s\n", ext+":", strings.Join(parts, ", "))
+	}
+}
+
+// percentOf returns part as percentage of total
+func percentOf(part, total int) float64 {
+	return float64(part) * 100 / float64(total)
+}
+
+// sourceOf fingerprints a rating source file, a missing file is recorded as such
+func sourceOf(file string, withHash bool) (Source, error) {
+	size, modTime, hash, err := fingerprint(file, withHash)
+	if errors.Is(err, os.ErrNotExist) {
+		return Source{File: file, Missing: true}, nil
+	}
+	if err != nil {
+		return Source{}, err
+	}
+	return Source{File: file, Size: size, ModTime: modTime, Hash: hash}, nil
+}
+
+// fingerprint returns size, modification time and optionally the SHA-256 of a file
+func fingerprint(path string, withHash bool) (int64, time.Time, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, time.Time{}, "", err
+	}
+	if !withHash {
+		return info.Size(), info.ModTime(), "", nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, time.Time{}, "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return 0, time.Time{}, "", fmt.Errorf("Error hashing %s: %v", path, err)
+	}
+	return info.Size(), info.ModTime(), hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,248 @@
+package plan
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/frommie/rawmanager/config"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "test.RAF")
+	if err := os.WriteFile(filePath, []byte("RAW"), 0644); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	p := New(tmpDir, true)
+	if err := p.Add(filePath, KindRaw, 1, ActionDelete, "Rating 1"); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	// Adding the same action twice must not duplicate the entry
+	if err := p.Add(filePath, KindRaw, 1, ActionDelete, "Rating 1"); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	planPath := filepath.Join(tmpDir, "plan.json")
+	if err := p.Save(planPath); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	loaded, err := Load(planPath)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(loaded.Entries) != 1 {
+		t.Fatalf("Entries = %d, want 1", len(loaded.Entries))
+	}
+	e := loaded.Entries[0]
+	if e.File != filePath || e.Rating != 1 || e.Action != ActionDelete || e.Size != 3 || e.Hash == "" {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+	if err := e.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestAddSidecarTargets(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "test.JPG")
+	if err := os.WriteFile(jpgPath, []byte("JPG"), 0644); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// A JPEG shared by two RAWs writes both sidecars, each once
+	p := New(tmpDir, false)
+	for _, target := range []string{"test.RAF.xmp", "test.DNG.xmp", "test.RAF.xmp"} {
+		if err := p.AddSidecar(jpgPath, 3, filepath.Join(tmpDir, target), "Rating 3"); err != nil {
+			t.Fatalf("AddSidecar() error = %v", err)
+		}
+	}
+	if len(p.Entries) != 2 || filepath.Base(p.Entries[1].Target) != "test.DNG.xmp" {
+		t.Errorf("Entries = %+v, want one sidecar write per target", p.Entries)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(path string) error
+		wantErr bool
+	}{
+		{
+			name:    "Unchanged file",
+			modify:  func(path string) error { return nil },
+			wantErr: false,
+		},
+		{
+			name:    "Size changed",
+			modify:  func(path string) error { return os.WriteFile(path, []byte("RAW DATA"), 0644) },
+			wantErr: true,
+		},
+		{
+			name: "Modification time changed",
+			modify: func(path string) error {
+				later := time.Now().Add(time.Hour)
+				return os.Chtimes(path, later, later)
+			},
+			wantErr: true,
+		},
+		{
+			name: "Content changed",
+			modify: func(path string) error {
+				info, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+				if err := os.WriteFile(path, []byte("FOO"), 0644); err != nil {
+					return err
+				}
+				return os.Chtimes(path, info.ModTime(), info.ModTime())
+			},
+			wantErr: true,
+		},
+		{
+			name:    "File removed",
+			modify:  os.Remove,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			filePath := filepath.Join(tmpDir, "test.JPG")
+			if err := os.WriteFile(filePath, []byte("JPG"), 0644); err != nil {
+				t.Fatalf("Setup failed: %v", err)
+			}
+
+			p := New(tmpDir, true)
+			if err := p.Add(filePath, KindJpeg, 2, ActionCompress, "Rating 2"); err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+			if err := tt.modify(filePath); err != nil {
+				t.Fatalf("Modify failed: %v", err)
+			}
+
+			err := p.Entries[0].Verify()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySources(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(jpgPath, sidecar string) error
+		wantErr bool
+	}{
+		{
+			name:    "Unchanged sources",
+			modify:  func(jpgPath, sidecar string) error { return nil },
+			wantErr: false,
+		},
+		{
+			name:    "JPEG changed",
+			modify:  func(jpgPath, sidecar string) error { return os.WriteFile(jpgPath, []byte("RATED JPG"), 0644) },
+			wantErr: true,
+		},
+		{
+			name:    "Sidecar created",
+			modify:  func(jpgPath, sidecar string) error { return os.WriteFile(sidecar, []byte("XMP"), 0644) },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			rawPath := filepath.Join(tmpDir, "test.RAF")
+			jpgPath := filepath.Join(tmpDir, "test.JPG")
+			sidecar := filepath.Join(tmpDir, "test.xmp")
+			for _, path := range []string{rawPath, jpgPath} {
+				if err := os.WriteFile(path, []byte("DATA"), 0644); err != nil {
+					t.Fatalf("Setup failed: %v", err)
+				}
+			}
+
+			p := New(tmpDir, false)
+			if err := p.Add(rawPath, KindRaw, 1, ActionDelete, "Rating 1"); err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+			if err := p.SetPair(0, jpgPath, rawPath, []string{jpgPath, sidecar, jpgPath}); err != nil {
+				t.Fatalf("SetPair() error = %v", err)
+			}
+			if len(p.Entries[0].Sources) != 2 {
+				t.Fatalf("Sources = %+v, want JPEG and sidecar", p.Entries[0].Sources)
+			}
+			if err := tt.modify(jpgPath, sidecar); err != nil {
+				t.Fatalf("Modify failed: %v", err)
+			}
+
+			err := p.Entries[0].Verify()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// A change by an applied entry of the run is accepted
+			if err := p.Refresh(0, jpgPath); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			if err := p.Refresh(0, sidecar); err != nil {
+				t.Fatalf("Refresh() error = %v", err)
+			}
+			if err := p.Entries[0].Verify(); err != nil {
+				t.Errorf("Verify() after Refresh() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	p := &Plan{
+		Entries: []Entry{
+			{File: "/lib/a/raw/1.RAF", Kind: KindRaw, Action: ActionDelete, Size: 100},
+			{File: "/lib/a/raw/2.RAF", Kind: KindRaw, Action: ActionDelete, Size: 100},
+			{File: "/lib/a/2.JPG", Kind: KindJpeg, Action: ActionDelete, Size: 10},
+			{File: "/lib/a/3.JPG", Kind: KindJpeg, Action: ActionCompress, Size: 10},
+			{File: "/lib/b/raw/1.RAF", Kind: KindRaw, Action: ActionDelete, Size: 100},
+		},
+		Stats: Stats{
+			RawFiles:     map[string]int{"/lib/a/raw": 4, "/lib/b/raw": 10},
+			RatingReads:  10,
+			RatingErrors: 3,
+		},
+	}
+
+	tests := []struct {
+		name    string
+		limits  config.LimitsConfig
+		wantErr bool
+	}{
+		{name: "No limits", limits: config.LimitsConfig{}, wantErr: false},
+		{name: "Deletes per folder ok", limits: config.LimitsConfig{MaxRawDeletesPerFolder: 2}, wantErr: false},
+		{name: "Deletes per folder exceeded", limits: config.LimitsConfig{MaxRawDeletesPerFolder: 1}, wantErr: true},
+		{name: "Percent per folder exceeded", limits: config.LimitsConfig{MaxRawDeletePercentPerFolder: 40}, wantErr: true},
+		{name: "Percent per folder ok", limits: config.LimitsConfig{MaxRawDeletePercentPerFolder: 50}, wantErr: false},
+		{name: "Deletes per run exceeded", limits: config.LimitsConfig{MaxRawDeletesPerRun: 2}, wantErr: true},
+		{name: "Percent per run ok", limits: config.LimitsConfig{MaxRawDeletePercentPerRun: 25}, wantErr: false},
+		{name: "Percent per run exceeded", limits: config.LimitsConfig{MaxRawDeletePercentPerRun: 20}, wantErr: true},
+		{name: "Bytes exceeded", limits: config.LimitsConfig{MaxBytesRemoved: 300}, wantErr: true},
+		{name: "Bytes ok", limits: config.LimitsConfig{MaxBytesRemoved: 310}, wantErr: false},
+		{name: "Rating errors exceeded", limits: config.LimitsConfig{MaxRatingErrorPercent: 25}, wantErr: true},
+		{name: "Rating errors ok", limits: config.LimitsConfig{MaxRatingErrorPercent: 30}, wantErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.CheckLimits(tt.limits)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,24 +1,53 @@
 package processor
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"github.com/frommie/rawmanager/archive"
 	"github.com/frommie/rawmanager/config"
 	"github.com/frommie/rawmanager/counter"
+	"github.com/frommie/rawmanager/fsutil"
+	"github.com/frommie/rawmanager/journal"
 	"github.com/frommie/rawmanager/jpeg"
+	"github.com/frommie/rawmanager/plan"
+	"github.com/frommie/rawmanager/source"
+	"github.com/frommie/rawmanager/state"
+	"github.com/frommie/rawmanager/trash"
+	"github.com/frommie/rawmanager/xmp"
 	"github.com/schollz/progressbar/v3"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type ImageProcessor struct {
-	RootDir string
-	Config  *config.Config
-	Verbose bool
-	counter *counter.FileCounter
-	jpegBar *progressbar.ProgressBar
-	rawBar  *progressbar.ProgressBar
+	RootDir  string
+	Config   *config.Config
+	Verbose  bool
+	Full     bool // Evaluate unchanged pairs too, their results are still stored
+	counter  *counter.FileCounter
+	plan     *plan.Plan
+	jpegBar  *progressbar.ProgressBar
+	rawBar   *progressbar.ProgressBar
+	applyBar *progressbar.ProgressBar
+	runID    string
+	remover  trash.Remover
+	journal  *journal.Journal
+	state    *state.State
+	pending  map[string]pendingPair
+	sources  *source.Chain
+	listings map[string][]string
+}
+
+// pendingPair is an evaluated pair whose actions still have to be applied.
+// In RAW-only mode jpgPath is empty and sidecar is set.
+type pendingPair struct {
+	jpgPath string
+	rawPath string
+	sidecar string
+	pair    state.PairState
 }
 
 func NewImageProcessor(rootDir string, cfg *config.Config, verbose bool) *ImageProcessor {
@@ -32,121 +61,1014 @@ func NewImageProcessor(rootDir string, cfg *config.Config, verbose bool) *ImageP
 // Helper method for output
 func (p *ImageProcessor) logf(format string, args ...interface{}) error {
 	if p.Verbose {
-		// Save position of both status bars
-		p.jpegBar.Clear()
-		p.rawBar.Clear()
+		// Save position of all status bars
+		bars := []*progressbar.ProgressBar{p.jpegBar, p.rawBar, p.applyBar}
+		for _, bar := range bars {
+			if bar != nil {
+				bar.Clear()
+			}
+		}
 		// Print message
 		fmt.Printf(format, args...)
 		// Restore status bars
-		p.rawBar.RenderBlank()
-		p.jpegBar.RenderBlank()
+		for i := len(bars) - 1; i >= 0; i-- {
+			if bars[i] != nil {
+				bars[i].RenderBlank()
+			}
+		}
 	}
 	// Return error with message
 	return fmt.Errorf(format, args...)
 }
 
-func (p *ImageProcessor) Process() error {
-	// Count files
-	p.counter = &counter.FileCounter{}
-	if err := p.counter.CountFiles(p.RootDir, p.Config); err != nil {
-		return err
-	}
-
-	// Initialize JPEG progress bar
-	p.jpegBar = progressbar.NewOptions(p.counter.JpegCount,
+// newProgressBar creates a progress bar in the style used for all phases
+func newProgressBar(max int, description string, color string) *progressbar.ProgressBar {
+	return progressbar.NewOptions(max,
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowCount(),
-		progressbar.OptionSetDescription("[cyan][1/2]Processing JPEGs..."),
+		progressbar.OptionSetDescription(description),
 		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "[green]=[reset]",
-			SaucerHead:    "[green]>[reset]",
+			Saucer:        "[" + color + "]=[reset]",
+			SaucerHead:    "[" + color + "]>[reset]",
 			SaucerPadding: " ",
 			BarStart:      "[",
 			BarEnd:        "]",
 		}))
+}
 
-	// Initialize RAW progress bar
-	p.rawBar = progressbar.NewOptions(p.counter.RawCount,
-		progressbar.OptionEnableColorCodes(true),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetDescription("[cyan][2/2]Processing RAWs... "),
-		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "[yellow]=[reset]",
-			SaucerHead:    "[yellow]>[reset]",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}))
+// Process plans all actions for the library and executes them right away
+func (p *ImageProcessor) Process() error {
+	pl, err := p.Plan(false)
+	if err != nil {
+		return err
+	}
+	return p.Apply(pl)
+}
 
-	// Start processing
+// Plan walks the library and collects all actions without executing them.
+// With hash enabled every entry is fingerprinted with its SHA-256.
+func (p *ImageProcessor) Plan(hash bool) (*plan.Plan, error) {
+	// Count files
+	p.counter = &counter.FileCounter{}
+	if err := p.counter.CountFiles(p.RootDir, p.Config); err != nil {
+		return nil, err
+	}
+
+	sources, err := source.NewChain(p.Config)
+	if err != nil {
+		return nil, err
+	}
+	p.sources = sources
+
+	if !p.Config.Files.RawOnly {
+		p.jpegBar = newProgressBar(p.counter.JpegCount, "[cyan][1/3]Processing JPEGs...", "green")
+	}
+	p.rawBar = newProgressBar(p.counter.RawCount, "[cyan][2/3]Processing RAWs... ", "yellow")
+
+	st, err := state.Load(p.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	p.state = st
+	p.pending = map[string]pendingPair{}
+	if p.Config.Incremental {
+		p.state.SetConfigHash(p.Config.Hash())
+	}
+
+	// Start planning
+	p.plan = plan.New(p.RootDir, hash)
+	for ext, count := range p.counter.ByExtension {
+		p.plan.Stats.Extensions[ext] = count
+	}
 	if err := p.Walk(); err != nil {
-		return err
+		return nil, err
+	}
+	if p.Config.Incremental && p.plan.Stats.Unchanged > 0 {
+		p.logf("Info: Skipped %d unchanged pairs\n", p.plan.Stats.Unchanged)
+	}
+
+	p.state.PruneOrphans()
+	if p.Config.Incremental {
+		p.state.PrunePairs()
+	}
+	if err := p.state.Save(); err != nil {
+		return nil, err
 	}
 
+	return p.plan, nil
+}
+
+// prepare sets up the run ID and the deletion backend before executing actions
+func (p *ImageProcessor) prepare() error {
+	if p.runID == "" {
+		p.runID = time.Now().Format(trash.RunIDFormat)
+	}
+	if p.remover == nil {
+		remover, err := trash.New(p.Config, p.RootDir, p.runID)
+		if err != nil {
+			return err
+		}
+		p.remover = remover
+	}
+	if p.journal == nil {
+		p.journal = journal.Open(journal.Dir(p.RootDir), p.runID)
+	}
 	return nil
 }
 
+// RunID returns the ID of the last run, which is needed to undo it
+func (p *ImageProcessor) RunID() string {
+	return p.runID
+}
+
+// Summary reports the ratings, actions and skipped files of the last run
+func (p *ImageProcessor) Summary() string {
+	if p.plan == nil {
+		return ""
+	}
+	return p.plan.Summary()
+}
+
+// Journaled reports whether the last run recorded any destructive step
+func (p *ImageProcessor) Journaled() bool {
+	return p.journal != nil && !p.journal.Empty()
+}
+
+// Apply executes a plan. Nothing is executed if the plan crosses a safety
+// limit, entries whose file or rating sources changed since planning are
+// refused.
+func (p *ImageProcessor) Apply(pl *plan.Plan) error {
+	if err := pl.CheckLimits(p.Config.Limits); err != nil {
+		return err
+	}
+	if err := p.prepare(); err != nil {
+		return err
+	}
+	defer p.journal.Close()
+	p.plan = pl
+
+	p.applyBar = newProgressBar(len(pl.Entries), "[cyan][3/3]Applying actions...", "red")
+
+	failed := map[string]bool{}
+	for i := range pl.Entries {
+		p.applyBar.Add(1)
+		if err := p.applyEntry(&pl.Entries[i]); err != nil {
+			p.logf("Warning: %v\n", err)
+			failed[pl.Entries[i].File] = true
+			continue
+		}
+		if err := p.refreshSources(pl, i); err != nil {
+			return err
+		}
+	}
+	return p.commitPairs(failed)
+}
+
+// applyEntry verifies a single entry and executes its action
+func (p *ImageProcessor) applyEntry(e *plan.Entry) error {
+	if err := e.Verify(); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			p.logf("Warning: %s has already been deleted\n", e.File)
+			return nil
+		}
+		return fmt.Errorf("Refusing to %s: %v", e.Action, err)
+	}
+	// Sidecar writes only touch the sidecar
+	protected := e.File
+	if e.Action == plan.ActionSidecar {
+		protected = e.Target
+	}
+	if protection := p.protectedBy(protected); protection != "" {
+		return p.refuseProtected(e.Action, protected, protection)
+	}
+	if e.Action != plan.ActionSidecar {
+		protection, err := p.pairProtection(e)
+		if err != nil {
+			return fmt.Errorf("Refusing to %s %s: %v", e.Action, e.File, err)
+		}
+		if protection != "" {
+			return p.refuseProtected(e.Action, e.File, protection)
+		}
+	}
+
+	switch e.Action {
+	case plan.ActionDelete:
+		p.logf("Deleting %s (%s)\n", e.File, e.Reason)
+		return p.deleteFile(e.File)
+	case plan.ActionCompress:
+		p.logf("Compressing JPEG %s (%s)\n", e.File, e.Reason)
+		return p.compressFile(e.File)
+	case plan.ActionMove:
+		p.logf("Moving %s to %s (%s)\n", e.File, e.Target, e.Reason)
+		return p.moveFile(e.File, e.Target)
+	case plan.ActionSidecar:
+		p.logf("Writing sidecar %s (%s)\n", e.Target, e.Reason)
+		return p.writeSidecar(e)
+	case plan.ActionCleanup:
+		p.logf("Removing %s (%s)\n", e.File, e.Reason)
+		return removeTemp(e.File)
+	default:
+		return fmt.Errorf("Invalid action %q for %s", e.Action, e.File)
+	}
+}
+
+// refuseProtected lists a file protected since planning as skipped, so the
+// summary names it and its protection
+func (p *ImageProcessor) refuseProtected(action plan.Action, file, protection string) error {
+	p.plan.Skip(file, fmt.Sprintf("%s refused, protected by %s", action, protection))
+	return fmt.Errorf("Refusing to %s %s: protected by %s", action, file, protection)
+}
+
+// ProcessJPEG plans and executes the actions for a single RAW+JPEG pair
 func (p *ImageProcessor) ProcessJPEG(jpgPath, rawPath string) error {
+	if err := p.prepare(); err != nil {
+		return err
+	}
+	defer p.journal.Close()
+
+	if _, err := p.chain(); err != nil {
+		return err
+	}
+
+	st, err := state.Load(p.RootDir)
+	if err != nil {
+		return err
+	}
+	p.state = st
+	p.pending = map[string]pendingPair{}
+	if p.Config.Incremental {
+		p.state.SetConfigHash(p.Config.Hash())
+	}
+
+	p.plan = plan.New(p.RootDir, false)
+	if err := p.planJPEG(jpgPath, rawPath); err != nil {
+		return err
+	}
+	if err := p.state.Save(); err != nil {
+		return err
+	}
+
+	for i := range p.plan.Entries {
+		if err := p.applyEntry(&p.plan.Entries[i]); err != nil {
+			return err
+		}
+		if err := p.refreshSources(p.plan, i); err != nil {
+			return err
+		}
+	}
+	return p.commitPairs(nil)
+}
+
+// refreshSources updates the rating sources of the entries after index i
+// with the files the applied entry changed, so the run does not veto itself
+func (p *ImageProcessor) refreshSources(pl *plan.Plan, i int) error {
+	e := pl.Entries[i]
+	if err := pl.Refresh(i+1, e.File); err != nil {
+		return err
+	}
+	if e.Target != "" {
+		return pl.Refresh(i+1, e.Target)
+	}
+	return nil
+}
+
+// planJPEG resolves the rating of a pair and adds the configured actions to the plan
+func (p *ImageProcessor) planJPEG(jpgPath, rawPath string) error {
 	// Check if JPEG exists
 	if _, err := os.Stat(jpgPath); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			// Apply NoJpegAction
-			if p.Config.NoJpegAction.DeleteRaw {
-				p.logf("Deleting %s (no corresponding JPG file found)\n", rawPath)
-				return os.Remove(rawPath)
-			}
-			return nil
+			return p.planOrphan(rawPath)
 		}
 		return err
 	}
 
-	// Get rating from JPEG or XMP file
-	rating, err := jpeg.GetRatingFromFile(jpgPath, p.Config)
+	// Skip pairs that are unchanged since the last run. Pairs are keyed by
+	// their RAW, since several RAWs can share a JPEG.
+	key := p.relPath(rawPath)
+	current := p.pairState(jpgPath, rawPath)
+	if p.skipUnchanged(key, current) {
+		return nil
+	}
+
+	// Get rating, label and pick flag from JPEG or XMP file
+	p.plan.Stats.RatingReads++
+	meta, conflict, err := p.sources.Lookup(source.Pair{Jpeg: jpgPath, Raw: rawPath})
 	if err != nil {
+		p.plan.Stats.RatingErrors++
 		return fmt.Errorf("Error reading rating: %v", err)
 	}
+	if conflict != nil {
+		if meta == nil {
+			p.logf("Warning: Skipping %s, rating sources disagree (%s)\n", jpgPath, conflict)
+			p.plan.Flag(jpgPath, conflict.Ratings(), "skipped")
+			p.plan.Skip(jpgPath, "rating sources disagree: "+conflict.String())
+			return nil
+		}
+		policy := p.Config.Xmp.ConflictPolicy()
+		p.logf("Warning: Rating sources of %s disagree (%s), using %s rating %d\n", jpgPath, conflict, policy, meta.Rating)
+		p.plan.Flag(jpgPath, conflict.Ratings(), fmt.Sprintf("%s: %d", policy, meta.Rating))
+	}
+	action, reason, err := p.evaluate(jpgPath, meta)
+	if err != nil {
+		return err
+	}
+	rating := meta.Rating
 
-	// Get configured actions for this rating
-	action, exists := p.Config.RatingActions[rating]
-	if !exists {
-		return p.logf("No action configured for rating %d", rating)
+	entries, skipped := len(p.plan.Entries), len(p.plan.Skipped)
+	var protection string
+	if action.DeleteRaw || action.DeleteJpeg || action.CompressJpeg {
+		protection = p.xmpProtection(meta)
+	}
+
+	// The sidecar is written first, while the JPEG is still unchanged
+	if p.Config.RawSidecar.Write && !action.DeleteRaw {
+		if err := p.planSidecar(jpgPath, rawPath, meta, reason); err != nil {
+			return err
+		}
 	}
 
-	// Execute configured actions
 	if action.DeleteRaw {
-		p.logf("Deleting RAW %s (Rating %d)\n", rawPath, rating)
-		if err := p.deleteFile(rawPath); err != nil {
+		if err := p.planAction(rawPath, plan.KindRaw, rating, plan.ActionDelete, reason, protection); err != nil {
 			return err
 		}
 	}
 
 	if action.DeleteJpeg {
-		p.logf("Deleting JPEG %s (Rating %d)\n", jpgPath, rating)
-		if err := p.deleteFile(jpgPath); err != nil {
+		if err := p.planAction(jpgPath, plan.KindJpeg, rating, plan.ActionDelete, reason, protection); err != nil {
 			return err
 		}
 	}
 
-	if action.CompressJpeg {
-		p.logf("Compressing JPEG %s (Rating %d)\n", jpgPath, rating)
-		if err := jpeg.ResizeWithXMP(jpgPath, p.Config, p.Verbose); err != nil {
+	if action.CompressJpeg && !action.DeleteJpeg && p.Config.Files.IsHeif(jpgPath) {
+		p.logf("Info: Not compressing %s (HEIF files cannot be compressed)\n", jpgPath)
+	} else if action.CompressJpeg && !action.DeleteJpeg {
+		if err := p.planAction(jpgPath, plan.KindJpeg, rating, plan.ActionCompress, reason, protection); err != nil {
+			return err
+		}
+	}
+
+	pair := source.Pair{Jpeg: jpgPath, Raw: rawPath}
+	if err := p.plan.SetPair(entries, jpgPath, rawPath, append([]string{jpgPath}, p.sources.Files(pair)...)); err != nil {
+		return err
+	}
+	p.remember(key, current, rating, action, entries, skipped, pendingPair{jpgPath: jpgPath, rawPath: rawPath})
+	return nil
+}
+
+// planRaw resolves the rating of a RAW from its XMP sidecar and adds the
+// configured RAW action for the RAW and its sidecar to the plan. JPEG
+// actions do not apply in RAW-only mode.
+func (p *ImageProcessor) planRaw(rawPath string) error {
+	sidecar := rawSidecar(rawPath)
+	if sidecar == "" {
+		p.logf("Info: Skipping %s (no XMP sidecar)\n", rawPath)
+		return nil
+	}
+
+	// Skip RAWs that are unchanged since the last run
+	key := p.relPath(rawPath)
+	current := rawState(rawPath, sidecar)
+	if p.skipUnchanged(key, current) {
+		return nil
+	}
+
+	// Get rating, label and pick flag from the sidecar
+	p.plan.Stats.RatingReads++
+	meta, err := xmp.GetMetadataFromFile(sidecar)
+	if err == nil {
+		err = source.Normalize(p.Config.Xmp, meta)
+	}
+	if err != nil {
+		p.plan.Stats.RatingErrors++
+		return fmt.Errorf("Error reading rating: %v", err)
+	}
+	action, reason, err := p.evaluate(rawPath, meta)
+	if err != nil {
+		return err
+	}
+
+	entries, skipped := len(p.plan.Entries), len(p.plan.Skipped)
+	if action.DeleteRaw {
+		// The sidecar shares the protection of its RAW
+		protection := p.xmpProtection(meta)
+		if protection == "" {
+			protection = p.protectedBy(rawPath)
+		}
+		if err := p.planAction(rawPath, plan.KindRaw, meta.Rating, plan.ActionDelete, reason, protection); err != nil {
+			return err
+		}
+		if err := p.planAction(sidecar, plan.KindSidecar, meta.Rating, plan.ActionDelete, reason, protection); err != nil {
 			return err
 		}
 	}
 
+	if err := p.plan.SetPair(entries, "", rawPath, []string{sidecar}); err != nil {
+		return err
+	}
+	p.remember(key, current, meta.Rating, action, entries, skipped, pendingPair{rawPath: rawPath, sidecar: sidecar})
 	return nil
 }
 
+// planSidecar adds a write of the JPEG's rating, label and keywords to the
+// RAW sidecar unless the sidecar already carries them
+func (p *ImageProcessor) planSidecar(jpgPath, rawPath string, meta *xmp.Metadata, reason string) error {
+	target := p.sidecarTarget(rawPath)
+	data, err := os.ReadFile(target)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Error reading sidecar %s: %v", target, err)
+	}
+	updated, err := xmp.Update(data, meta)
+	if err != nil {
+		return fmt.Errorf("Error updating sidecar %s: %v", target, err)
+	}
+	if bytes.Equal(updated, data) {
+		return nil
+	}
+	return p.plan.AddSidecar(jpgPath, meta.Rating, target, reason)
+}
+
+// sidecarTarget returns the sidecar path of a RAW file in the configured naming
+func (p *ImageProcessor) sidecarTarget(rawPath string) string {
+	paths := xmp.RawSidecarPaths(rawPath)
+	if p.Config.RawSidecar.Naming == config.SidecarNamingBase {
+		return paths[1]
+	}
+	return paths[0]
+}
+
+// rawSidecar returns the existing XMP sidecar of a RAW file, or ""
+func rawSidecar(rawPath string) string {
+	for _, path := range xmp.RawSidecarPaths(rawPath) {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// skipUnchanged reports whether the pair key is unchanged since the last
+// run and counts it as such. Full runs evaluate every pair.
+func (p *ImageProcessor) skipUnchanged(key string, current state.PairState) bool {
+	if !p.Config.Incremental || p.Full {
+		return false
+	}
+	cached, unchanged := p.state.UnchangedPair(key, current)
+	if !unchanged {
+		return false
+	}
+	p.plan.Stats.Unchanged++
+	p.plan.Stats.Ratings[cached.Rating]++
+	return true
+}
+
+// evaluate returns the action of the pair of file with the given metadata.
+// A flag or label with an action is enough for unrated images.
+func (p *ImageProcessor) evaluate(file string, meta *xmp.Metadata) (config.Action, string, error) {
+	action, reason, exists := p.resolveAction(meta)
+	if !exists {
+		if !meta.Rated {
+			p.plan.Stats.RatingErrors++
+			return action, "", fmt.Errorf("Error reading rating: No rating found in XMP data")
+		}
+		return action, "", p.logf("No action configured for rating %d", meta.Rating)
+	}
+	p.plan.Stats.Ratings[meta.Rating]++
+	if meta.Rated {
+		p.plan.Rated(file, meta.Scale, meta.Percent, meta.Rating)
+	}
+	return action, reason, nil
+}
+
+// remember stores the evaluation of a pair, for pairs with actions once they
+// are applied. Protected pairs are always evaluated again.
+func (p *ImageProcessor) remember(key string, current state.PairState, rating int, action config.Action, entries, skipped int, pending pendingPair) {
+	if !p.Config.Incremental || len(p.plan.Skipped) != skipped {
+		return
+	}
+	current.Rating = rating
+	current.Action = describeAction(action)
+	if len(p.plan.Entries) == entries {
+		p.state.SetPair(key, current)
+		return
+	}
+	pending.pair = current
+	p.pending[key] = pending
+}
+
+// rawState returns the current state of a RAW file and its sidecar
+func rawState(rawPath, sidecar string) state.PairState {
+	var pair state.PairState
+	if rawState := state.Stat(rawPath); rawState != nil {
+		pair.Raw = *rawState
+	}
+	pair.Sidecar = state.Stat(sidecar)
+	return pair
+}
+
+// pairState returns the current state of the files of a pair
+func (p *ImageProcessor) pairState(jpgPath, rawPath string) state.PairState {
+	var pair state.PairState
+	if jpgState := state.Stat(jpgPath); jpgState != nil {
+		pair.Jpeg = *jpgState
+	}
+	if rawState := state.Stat(rawPath); rawState != nil {
+		pair.Raw = *rawState
+	}
+	for _, file := range p.sources.Files(source.Pair{Jpeg: jpgPath, Raw: rawPath}) {
+		if fileState := state.Stat(file); fileState != nil {
+			if pair.Sources == nil {
+				pair.Sources = map[string]state.FileState{}
+			}
+			pair.Sources[p.relPath(file)] = *fileState
+		}
+	}
+	return pair
+}
+
+// commitPairs stores the evaluations of pending pairs after their actions
+// were applied, using the state of their files after the changes
+func (p *ImageProcessor) commitPairs(failed map[string]bool) error {
+	if p.state == nil || len(p.pending) == 0 {
+		return nil
+	}
+
+	for key, pending := range p.pending {
+		if failed[pending.jpgPath] || failed[pending.rawPath] {
+			p.state.ForgetPair(key)
+			continue
+		}
+		if failed[pending.sidecar] {
+			p.state.ForgetPair(key)
+			continue
+		}
+
+		// Pairs whose rated file is gone need no evaluation anymore
+		var current state.PairState
+		rated := pending.jpgPath
+		if rated == "" {
+			rated = pending.rawPath
+			current = rawState(pending.rawPath, pending.sidecar)
+		} else {
+			current = p.pairState(pending.jpgPath, pending.rawPath)
+		}
+		if _, err := os.Stat(rated); err != nil {
+			p.state.ForgetPair(key)
+			continue
+		}
+		current.Rating = pending.pair.Rating
+		current.Action = pending.pair.Action
+		p.state.SetPair(key, current)
+	}
+	p.pending = nil
+	return p.state.Save()
+}
+
+// resolveAction selects the action of a pair and the reason for it, with
+// the keyword rules applied on top
+func (p *ImageProcessor) resolveAction(meta *xmp.Metadata) (config.Action, string, bool) {
+	action, reason, exists := p.baseAction(meta)
+	if !exists || len(p.Config.KeywordRules) == 0 {
+		return action, reason, exists
+	}
+	action, matched := p.Config.ApplyKeywordRules(action, meta.HasKeyword)
+	if len(matched) > 0 {
+		reason += ", keyword " + strings.Join(matched, ", ")
+	}
+	return action, reason, true
+}
+
+// baseAction selects the action of a pair by its markers. Rejects take
+// precedence over pick flags, pick flags over color labels and labels over
+// star ratings.
+func (p *ImageProcessor) baseAction(meta *xmp.Metadata) (config.Action, string, bool) {
+	if meta.Rated && meta.Rating == config.RejectedRating {
+		return p.Config.RejectAction, ratingReason(meta.Rating), true
+	}
+	if action, exists := p.Config.PickAction(string(meta.Pick)); exists {
+		if meta.Pick == xmp.Unflagged {
+			return action, "Unflagged", true
+		}
+		return action, "Flagged " + string(meta.Pick), true
+	}
+	if action, exists := p.Config.LabelAction(meta.Label); exists {
+		return action, "Label " + meta.Label, true
+	}
+	if !meta.Rated {
+		return config.Action{}, "", false
+	}
+	action, exists := p.Config.ActionFor(meta.Rating)
+	return action, ratingReason(meta.Rating), exists
+}
+
+// ratingReason describes the rating that led to an action
+func ratingReason(rating int) string {
+	if rating == config.RejectedRating {
+		return "Rejected"
+	}
+	return fmt.Sprintf("Rating %d", rating)
+}
+
+// describeAction summarizes a configured action, e.g. for the state file
+func describeAction(action config.Action) string {
+	var parts []string
+	if action.DeleteRaw {
+		parts = append(parts, "deleteRaw")
+	}
+	if action.DeleteJpeg {
+		parts = append(parts, "deleteJpeg")
+	}
+	if action.CompressJpeg {
+		parts = append(parts, "compressJpeg")
+	}
+	if len(parts) == 0 {
+		return "keep"
+	}
+	return strings.Join(parts, "+")
+}
+
+// planAction adds an action to the plan unless the file is protected.
+// A non-empty protection (e.g. from the pair's XMP) protects the file as well.
+func (p *ImageProcessor) planAction(file string, kind plan.Kind, rating int, action plan.Action, reason string, protection string) error {
+	if protection == "" {
+		protection = p.protectedBy(file)
+	}
+	if protection != "" {
+		p.logf("Skipping %s %s (%s, protected by %s)\n", action, file, reason, protection)
+		p.plan.Skip(file, fmt.Sprintf("%s skipped, protected by %s", action, protection))
+		return nil
+	}
+	return p.plan.Add(file, kind, rating, action, reason)
+}
+
+// planOrphan applies the orphan policy to a RAW file without JPEG
+func (p *ImageProcessor) planOrphan(rawPath string) error {
+	policy := p.Config.OrphanPolicy()
+	firstSeen := p.state.SeenOrphan(p.relPath(rawPath), time.Now())
+
+	if policy == config.OrphanKeep {
+		return nil
+	}
+
+	reason := "no corresponding JPG file found"
+	if days := p.Config.Orphan.AfterDays; days > 0 {
+		due := firstSeen.Add(time.Duration(days) * 24 * time.Hour)
+		if time.Now().Before(due) {
+			p.logf("Info: Keeping orphaned RAW %s until %s\n", rawPath, due.Format("2006-01-02"))
+			return nil
+		}
+		reason = fmt.Sprintf("no corresponding JPG file found since %s", firstSeen.Format("2006-01-02"))
+	}
+
+	if policy == config.OrphanMove {
+		if protection := p.protectedBy(rawPath); protection != "" {
+			p.logf("Skipping %s %s (%s, protected by %s)\n", plan.ActionMove, rawPath, reason, protection)
+			p.plan.Skip(rawPath, fmt.Sprintf("%s skipped, protected by %s", plan.ActionMove, protection))
+			return nil
+		}
+		moveTo := p.Config.Orphan.MoveTo
+		if moveTo == "" {
+			moveTo = config.DefaultOrphanDir
+		}
+		target := filepath.Join(config.ResolvePath(absPath(p.RootDir), moveTo), p.relPath(rawPath))
+		return p.plan.AddMove(rawPath, plan.KindRaw, 0, target, reason)
+	}
+
+	return p.planAction(rawPath, plan.KindRaw, 0, plan.ActionDelete, reason, "")
+}
+
+// relPath returns path relative to the library root
+func (p *ImageProcessor) relPath(path string) string {
+	rel, err := filepath.Rel(absPath(p.RootDir), absPath(path))
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// protectedBy returns the keep marker or file attribute that protects path,
+// or an empty string if the file may be changed
+func (p *ImageProcessor) protectedBy(path string) string {
+	// Marker for the single file
+	if _, err := os.Stat(path + config.KeepMarker); err == nil {
+		return path + config.KeepMarker
+	}
+
+	// Marker in the folder or one of its parents within the library
+	root := absPath(p.RootDir)
+	for dir := filepath.Dir(absPath(path)); ; dir = filepath.Dir(dir) {
+		marker := filepath.Join(dir, config.KeepMarker)
+		if _, err := os.Stat(marker); err == nil {
+			return marker
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	if p.Config.Protect.ReadOnly {
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0222 == 0 {
+			return "read-only bit"
+		}
+	}
+	return ""
+}
+
+// chain returns the rating sources of the run, created on first use when a
+// plan is applied without planning
+func (p *ImageProcessor) chain() (*source.Chain, error) {
+	if p.sources == nil {
+		sources, err := source.NewChain(p.Config)
+		if err != nil {
+			return nil, err
+		}
+		p.sources = sources
+	}
+	return p.sources, nil
+}
+
+// pairProtection reads the metadata of an entry's pair again and returns its
+// protected label or keyword. The fingerprint of a RAW does not cover XMP
+// changes of its JPEG since planning.
+func (p *ImageProcessor) pairProtection(e *plan.Entry) (string, error) {
+	if len(p.Config.Protect.Labels) == 0 && len(p.Config.Protect.Keywords) == 0 {
+		return "", nil
+	}
+
+	var meta *xmp.Metadata
+	switch {
+	case e.Jpeg != "" && !fileExists(e.Jpeg):
+		// Verify refuses JPEGs removed since planning, so an earlier entry
+		// of the run deleted it after checking the same metadata
+		return "", nil
+	case e.Jpeg != "":
+		sources, err := p.chain()
+		if err != nil {
+			return "", err
+		}
+		if meta, _, err = sources.Lookup(source.Pair{Jpeg: e.Jpeg, Raw: e.Raw}); err != nil {
+			return "", fmt.Errorf("Error reading metadata of %s: %v", e.Jpeg, err)
+		}
+		if meta == nil {
+			return "", fmt.Errorf("rating sources of %s disagree", e.Jpeg)
+		}
+	case e.Raw != "":
+		sidecar := rawSidecar(e.Raw)
+		if sidecar == "" {
+			return "", nil
+		}
+		var err error
+		if meta, err = xmp.GetMetadataFromFile(sidecar); err != nil {
+			return "", fmt.Errorf("Error reading metadata of %s: %v", sidecar, err)
+		}
+	default:
+		return "", nil
+	}
+	return p.xmpProtection(meta), nil
+}
+
+// xmpProtection returns the protected label or keyword of a JPEG's XMP data
+func (p *ImageProcessor) xmpProtection(meta *xmp.Metadata) string {
+	protect := p.Config.Protect
+
+	if meta.Label != "" {
+		for _, protected := range protect.Labels {
+			if strings.EqualFold(meta.Label, protected) {
+				return "XMP label " + meta.Label
+			}
+		}
+	}
+
+	for _, protected := range protect.Keywords {
+		if meta.HasKeyword(protected) {
+			return "XMP keyword " + protected
+		}
+	}
+	return ""
+}
+
 func (p *ImageProcessor) deleteFile(path string) error {
-	if err := os.Remove(path); err != nil {
+	info, err := os.Stat(path)
+	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return fmt.Errorf("Error deleting %s: %v", path, err)
 		}
 		p.logf("Warning: %s has already been deleted\n", path)
+		return nil
+	}
+
+	location, err := p.remover.Reserve(path)
+	if err != nil {
+		return fmt.Errorf("Error deleting %s: %v", path, err)
+	}
+
+	// The journal is written ahead, a crash must not lose a deletion.
+	// Permanently removed files are recorded without backup.
+	if err := p.journal.Record(journal.Entry{
+		Op:      journal.OpDelete,
+		Path:    absPath(path),
+		Backup:  location,
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}); err != nil {
+		return err
+	}
+	if err := p.remover.Remove(path, location); err != nil {
+		return fmt.Errorf("Error deleting %s: %v", path, err)
+	}
+	if location != "" {
+		p.logf("Info: %s moved to %s\n", path, location)
+	}
+	return nil
+}
+
+// removeTemp removes a leftover temporary file directly. Other files are
+// refused, since they are neither journaled nor counted by the limits.
+func removeTemp(path string) error {
+	if !fsutil.IsTemp(path) {
+		return fmt.Errorf("Refusing to clean up %s: not a temporary file", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Error removing %s: %v", path, err)
+	}
+	return nil
+}
+
+// moveFile moves a file within or out of the library and journals the move
+func (p *ImageProcessor) moveFile(path, target string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := p.journal.Record(journal.Entry{
+		Op:      journal.OpMove,
+		Path:    absPath(path),
+		Backup:  absPath(target),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}); err != nil {
+		return err
+	}
+	return trash.MoveFile(path, target)
+}
+
+// compressFile journals the original JPEG before resizing it. The original
+// is kept for undo if it is archived or process.journalBackup is set.
+func (p *ImageProcessor) compressFile(path string) error {
+	if p.Config.Files.IsHeif(path) {
+		return fmt.Errorf("Cannot compress HEIF file %s", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	// The archived original doubles as backup for the journal
+	var backup string
+	if p.Config.Process.KeepOriginal.Enabled {
+		backup, err = archive.Store(p.Config, p.RootDir, path)
+		if err == nil {
+			p.logf("Info: Original of %s archived to %s\n", path, backup)
+		}
+	} else if p.Config.Process.JournalBackup {
+		backup, err = p.journal.Backup(absPath(path), absPath(p.RootDir))
+	}
+	if err != nil {
+		return err
+	}
+	if backup != "" {
+		backup = absPath(backup)
+	}
+	if err := p.journal.Record(journal.Entry{
+		Op:      journal.OpOverwrite,
+		Path:    absPath(path),
+		Backup:  backup,
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}); err != nil {
+		return err
+	}
+
+	return jpeg.ResizeWithXMP(path, p.Config, p.Verbose)
+}
+
+// writeSidecar copies the rating, label and keywords of a pair into the RAW
+// sidecar at the entry's target and journals the change. The metadata is
+// looked up in the same sources as when planning.
+func (p *ImageProcessor) writeSidecar(e *plan.Entry) error {
+	sources, err := p.chain()
+	if err != nil {
+		return err
+	}
+	meta, _, err := sources.Lookup(source.Pair{Jpeg: e.File, Raw: e.Raw})
+	if err != nil {
+		return fmt.Errorf("Error reading rating: %v", err)
+	}
+	if meta == nil {
+		return fmt.Errorf("Rating sources of %s disagree", e.File)
+	}
+
+	target := e.Target
+
+	entry := journal.Entry{Op: journal.OpCreate, Path: absPath(target)}
+	if info, err := os.Stat(target); err == nil {
+		backup, err := p.journal.Backup(absPath(target), absPath(p.RootDir))
+		if err != nil {
+			return err
+		}
+		entry = journal.Entry{
+			Op:      journal.OpOverwrite,
+			Path:    absPath(target),
+			Backup:  absPath(backup),
+			ModTime: info.ModTime(),
+			Mode:    info.Mode(),
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Error reading sidecar %s: %v", target, err)
+	}
+	if err := p.journal.Record(entry); err != nil {
+		return err
+	}
+
+	return xmp.UpdateFile(target, meta)
+}
+
+// RestoreOriginals puts archived originals back whose JPEG is no longer
+// rated for compression. With all set every archived original is restored.
+func (p *ImageProcessor) RestoreOriginals(all bool) (int, error) {
+	originals, err := archive.List(p.Config, p.RootDir, p.RootDir)
+	if err != nil {
+		return 0, err
+	}
+	sources, err := p.chain()
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	for _, jpgPath := range originals {
+		if _, err := os.Stat(jpgPath); err != nil {
+			p.logf("Info: Skipping %s (JPEG no longer exists)\n", jpgPath)
+			continue
+		}
+
+		if !all {
+			meta, err := jpeg.GetMetadataFromFile(jpgPath, sources)
+			if err != nil {
+				p.logf("Warning: Error reading rating of %s: %v\n", jpgPath, err)
+				continue
+			}
+			action, _, exists := p.resolveAction(meta)
+			if !exists && !meta.Rated {
+				p.logf("Warning: No rating found for %s\n", jpgPath)
+				continue
+			}
+			if exists && action.CompressJpeg {
+				continue
+			}
+		}
+
+		if err := p.RestoreOriginal(jpgPath); err != nil {
+			p.logf("Warning: %v\n", err)
+			continue
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// RestoreOriginal puts the archived original of a single JPEG back
+func (p *ImageProcessor) RestoreOriginal(jpgPath string) error {
+	if err := archive.Restore(p.Config, p.RootDir, jpgPath); err != nil {
+		return err
 	}
+	p.logf("Restored original of %s\n", jpgPath)
 	return nil
 }
 
+// isInternalDir reports whether path is one of the folders rawmanager writes to
+func (p *ImageProcessor) isInternalDir(path string) bool {
+	for _, dir := range p.Config.InternalDirs(p.RootDir) {
+		if absPath(path) == absPath(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileExists reports whether path exists
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// absPath returns the absolute form of path, or path itself if it cannot be resolved
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
 func (p *ImageProcessor) deleteFiles(paths ...string) error {
 	for _, path := range paths {
 		if err := p.deleteFile(path); err != nil {
@@ -161,9 +1083,18 @@ func (p *ImageProcessor) ProcessDirectory(rawDir string, parentDir string) error
 	if err := p.validateDirectories(rawDir, parentDir); err != nil {
 		return err
 	}
+	p.listings = nil
 
-	if err := p.processJpegFiles(rawDir, parentDir); err != nil {
-		return err
+	p.planTempFiles(parentDir)
+	if rawDir != parentDir {
+		p.planTempFiles(rawDir)
+	}
+
+	// In RAW-only mode ratings are read from the RAW sidecars
+	if !p.Config.Files.RawOnly {
+		if err := p.processJpegFiles(rawDir, parentDir); err != nil {
+			return err
+		}
 	}
 
 	if err := p.processRawFiles(rawDir, parentDir); err != nil {
@@ -185,6 +1116,24 @@ func (p *ImageProcessor) validateDirectories(rawDir string, parentDir string) er
 	return nil
 }
 
+// planTempFiles plans the cleanup of leftovers of interrupted JPEG and
+// sidecar writes in dir
+func (p *ImageProcessor) planTempFiles(dir string) {
+	temps, legacy, err := jpeg.FindTempFiles(dir, p.Config.Files.JpegExts())
+	if err != nil && !os.IsNotExist(err) {
+		p.logf("Warning: %v\n", err)
+	}
+	for _, path := range temps {
+		if err := p.planAction(path, plan.KindTemp, 0, plan.ActionCleanup, "leftover temporary file", ""); err != nil {
+			p.logf("Warning: %v\n", err)
+		}
+	}
+	for _, path := range legacy {
+		p.logf("Warning: %s looks like a leftover temporary file of an older version, remove it if it is not needed\n", path)
+		p.plan.Skip(path, "possible leftover temporary file of an older version")
+	}
+}
+
 // Processing JPEG files
 func (p *ImageProcessor) processJpegFiles(rawDir string, parentDir string) error {
 	jpegFiles, err := os.ReadDir(parentDir)
@@ -205,21 +1154,28 @@ func (p *ImageProcessor) processJpegFiles(rawDir string, parentDir string) error
 	return nil
 }
 
-// Processing of single JPEG file
+// Processing of single JPEG or HEIF file
 func (p *ImageProcessor) processJpegFile(file os.DirEntry, rawDir string, parentDir string) error {
-	if !file.IsDir() && strings.HasSuffix(strings.ToUpper(file.Name()), p.Config.Files.JpegExtension) {
+	ext, companion := p.Config.Files.CompanionExtension(file.Name())
+	if !file.IsDir() && companion {
 		p.jpegBar.Add(1)
 		jpgPath := filepath.Join(parentDir, file.Name())
-		rawName := file.Name()[:len(file.Name())-len(p.Config.Files.JpegExtension)] + p.Config.Files.RawExtension
-		rawPath := filepath.Join(rawDir, rawName)
-
-		if _, err := os.Stat(rawPath); err != nil && os.IsNotExist(err) {
+		rawPaths, err := p.findFiles(rawDir, file.Name()[:len(file.Name())-len(ext)], p.Config.Files.RawExts())
+		if err != nil {
+			return fmt.Errorf("Error when checking RAW of %s: %v", jpgPath, err)
+		}
+		if len(rawPaths) == 0 {
 			return fmt.Errorf("No RAW file found for: %s", jpgPath)
 		}
 
-		if err := p.ProcessJPEG(jpgPath, rawPath); err != nil {
-			return fmt.Errorf("Error when processing %s: %v", jpgPath, err)
+		// Every RAW sharing the JPEG's name forms a pair with it
+		var errs []error
+		for _, rawPath := range rawPaths {
+			if err := p.planJPEG(jpgPath, rawPath); err != nil {
+				errs = append(errs, fmt.Errorf("Error when processing %s: %v", rawPath, err))
+			}
 		}
+		return errors.Join(errs...)
 	}
 	return nil
 }
@@ -246,26 +1202,75 @@ func (p *ImageProcessor) processRawFiles(rawDir string, parentDir string) error
 
 // Processing of single RAW file
 func (p *ImageProcessor) processRawFile(file os.DirEntry, rawDir string, parentDir string) error {
-	if !file.IsDir() && strings.HasSuffix(strings.ToUpper(file.Name()), p.Config.Files.RawExtension) {
+	ext, isRaw := p.Config.Files.RawExtensionOf(file.Name())
+	if !file.IsDir() && isRaw {
 		p.rawBar.Add(1)
+		p.plan.Stats.RawFiles[filepath.Clean(rawDir)]++
 		rawPath := filepath.Join(rawDir, file.Name())
-		jpgName := file.Name()[:len(file.Name())-len(p.Config.Files.RawExtension)] + p.Config.Files.JpegExtension
-		jpgPath := filepath.Join(parentDir, jpgName)
-
-		if _, err := os.Stat(jpgPath); err != nil {
-			if os.IsNotExist(err) {
-				if err := p.deleteFile(rawPath); err != nil {
-					return fmt.Errorf("Error when deleting %s: %v", rawPath, err)
-				}
-				p.logf("Info: RAW file deleted (no JPG found): %s\n", rawPath)
-			} else {
-				return fmt.Errorf("Error when checking %s: %v", jpgPath, err)
+		if p.Config.Files.RawOnly {
+			if err := p.planRaw(rawPath); err != nil {
+				return fmt.Errorf("Error when processing %s: %v", rawPath, err)
 			}
+			return nil
+		}
+		// Any JPEG or HEIF companion keeps the RAW from being an orphan
+		companions, err := p.findFiles(parentDir, file.Name()[:len(file.Name())-len(ext)], p.Config.Files.CompanionExtensions())
+		if err != nil {
+			return fmt.Errorf("Error when checking companion of %s: %v", rawPath, err)
+		}
+		if len(companions) > 0 {
+			return nil
+		}
+		if err := p.planOrphan(rawPath); err != nil {
+			return fmt.Errorf("Error when planning %s: %v", rawPath, err)
 		}
 	}
 	return nil
 }
 
+// findFiles returns the files in dir named base with one of exts, compared
+// case-insensitively, in the order of exts
+func (p *ImageProcessor) findFiles(dir, base string, exts []string) ([]string, error) {
+	names, err := p.listDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	seen := map[string]bool{}
+	for _, ext := range exts {
+		for _, name := range names {
+			if !seen[name] && strings.EqualFold(name, base+ext) {
+				seen[name] = true
+				files = append(files, filepath.Join(dir, name))
+			}
+		}
+	}
+	return files, nil
+}
+
+// listDir returns the names of the files in dir, each directory is read once
+// per ProcessDirectory
+func (p *ImageProcessor) listDir(dir string) ([]string, error) {
+	if names, exists := p.listings[dir]; exists {
+		return names, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	if p.listings == nil {
+		p.listings = map[string][]string{}
+	}
+	p.listings[dir] = names
+	return names, nil
+}
+
 func (p *ImageProcessor) Walk() error {
 	return filepath.Walk(p.RootDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -277,6 +1282,11 @@ func (p *ImageProcessor) Walk() error {
 			return nil
 		}
 
+		// Skip hidden directories and the folders rawmanager writes to
+		if info.IsDir() && path != p.RootDir && (strings.HasPrefix(info.Name(), ".") || p.isInternalDir(path)) {
+			return filepath.SkipDir
+		}
+
 		// If RAWs are in same directory, process each directory
 		if p.Config.Files.SameDir {
 			if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
@@ -6,12 +6,19 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/frommie/rawmanager/config"
 	"github.com/frommie/rawmanager/counter"
+	"github.com/frommie/rawmanager/journal"
+	"github.com/frommie/rawmanager/plan"
+	"github.com/frommie/rawmanager/rating"
+	"github.com/frommie/rawmanager/state"
 	"github.com/frommie/rawmanager/testutils"
+	"github.com/frommie/rawmanager/xmp"
 	"github.com/schollz/progressbar/v3"
 )
 
@@ -277,3 +284,1306 @@ func TestEnglishMessages(t *testing.T) {
 		t.Error("Expected log message not found in output")
 	}
 }
+
+func TestPlanAndApply(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	files := map[string]int{
+		"img1": 1,
+		"img2": 3,
+	}
+	for name, rating := range files {
+		jpgPath := filepath.Join(tmpDir, name+".JPG")
+		rawPath := filepath.Join(tmpDir, "raw", name+".RAF")
+		if err := createTestFiles(t, jpgPath, rawPath, rating); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+	}
+	orphanPath := filepath.Join(tmpDir, "raw", "img3.RAF")
+	if err := os.WriteFile(orphanPath, []byte("RAW"), 0644); err != nil {
+		t.Fatalf("Failed to create orphan RAW: %v", err)
+	}
+
+	proc := NewImageProcessor(tmpDir, config.NewDefaultConfig(), false)
+	pl, err := proc.Plan(true)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	// Planning must not touch any file
+	for _, path := range []string{
+		filepath.Join(tmpDir, "img1.JPG"),
+		filepath.Join(tmpDir, "raw", "img1.RAF"),
+		orphanPath,
+	} {
+		if !checkFileExists(t, path) {
+			t.Errorf("%s was removed during planning", path)
+		}
+	}
+	if len(pl.Entries) != 3 {
+		t.Fatalf("Plan has %d entries, want 3: %+v", len(pl.Entries), pl.Entries)
+	}
+
+	// Changing a planned file after planning must veto its entry
+	if err := os.WriteFile(orphanPath, []byte("NEW RAW"), 0644); err != nil {
+		t.Fatalf("Failed to modify orphan RAW: %v", err)
+	}
+
+	if err := proc.Apply(pl); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	if checkFileExists(t, filepath.Join(tmpDir, "img1.JPG")) {
+		t.Error("img1.JPG should have been deleted")
+	}
+	if checkFileExists(t, filepath.Join(tmpDir, "raw", "img1.RAF")) {
+		t.Error("img1.RAF should have been deleted")
+	}
+	if !checkFileExists(t, filepath.Join(tmpDir, "raw", "img2.RAF")) {
+		t.Error("img2.RAF should have been kept")
+	}
+	if !checkFileExists(t, orphanPath) {
+		t.Error("Modified orphan RAW should have been refused")
+	}
+}
+
+func TestRatingChangedAfterPlanning(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img1.JPG")
+	rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+	if err := createTestFiles(t, jpgPath, rawPath, 1); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.RatingActions[1] = config.Action{DeleteRaw: true}
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	pl, err := proc.Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(pl.Entries) != 1 || pl.Entries[0].File != rawPath {
+		t.Fatalf("Plan entries = %+v, want the RAW deletion", pl.Entries)
+	}
+
+	// Re-rating the JPEG after planning must veto the RAW deletion
+	later := time.Now().Add(time.Hour)
+	if err := testutils.CreateTestJPEGWithEmbeddedXMP(t, jpgPath, 5); err != nil {
+		t.Fatalf("Failed to re-rate JPEG: %v", err)
+	}
+	if err := os.Chtimes(jpgPath, later, later); err != nil {
+		t.Fatalf("Failed to touch JPEG: %v", err)
+	}
+
+	if err := proc.Apply(pl); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !checkFileExists(t, rawPath) {
+		t.Error("RAW was deleted although its JPEG was re-rated after planning")
+	}
+}
+
+func TestLeftoverTempFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := createTestFiles(t, filepath.Join(tmpDir, "img1.JPG"), filepath.Join(tmpDir, "raw", "img1.RAF"), 3); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+	tempPath := filepath.Join(tmpDir, ".rawmanager-123.tmp")
+	legacyPath := filepath.Join(tmpDir, "img1_temp.jpg")
+	for _, path := range []string{tempPath, legacyPath} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create temporary file: %v", err)
+		}
+	}
+
+	// Cleanups bypass the deletion backend and the safety limits
+	cfg := config.NewDefaultConfig()
+	cfg.Delete.Mode = config.DeleteModeQuarantine
+	cfg.Limits.MaxBytesRemoved = 1
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	pl, err := proc.Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if !checkFileExists(t, tempPath) {
+		t.Fatal("Temporary file was removed during planning")
+	}
+	if !pl.Has(tempPath, plan.ActionCleanup) {
+		t.Errorf("Temporary file not planned for cleanup: %+v", pl.Entries)
+	}
+	if len(pl.Skipped) != 1 || pl.Skipped[0].File != legacyPath {
+		t.Errorf("Skipped = %+v, want the legacy temporary file reported", pl.Skipped)
+	}
+
+	if err := proc.Apply(pl); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if checkFileExists(t, tempPath) {
+		t.Error("Temporary file should have been removed")
+	}
+	if proc.Journaled() || checkFileExists(t, filepath.Join(tmpDir, config.DefaultQuarantineDir)) {
+		t.Error("Temporary file should have been removed without journal and quarantine")
+	}
+	if !checkFileExists(t, legacyPath) {
+		t.Error("Legacy temporary file should only be reported")
+	}
+}
+
+func TestQuarantineDeletion(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img1.JPG")
+	rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+	if err := createTestFiles(t, jpgPath, rawPath, 1); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Delete.Mode = config.DeleteModeQuarantine
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	if err := proc.Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	quarantined := filepath.Join(tmpDir, config.DefaultQuarantineDir, proc.runID, "raw", "img1.RAF")
+	if !checkFileExists(t, quarantined) {
+		t.Errorf("RAW not found in quarantine at %s", quarantined)
+	}
+	if checkFileExists(t, rawPath) {
+		t.Error("RAW should have been moved out of the library")
+	}
+
+	// A second run must not pick up the quarantined files
+	proc = NewImageProcessor(tmpDir, cfg, false)
+	if err := proc.Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if proc.counter.RawCount != 0 || proc.counter.JpegCount != 0 {
+		t.Errorf("Quarantine was counted: %+v", proc.counter)
+	}
+}
+
+func TestUndoRun(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img1.JPG")
+	rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+	if err := createTestFiles(t, jpgPath, rawPath, 2); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+	original, err := os.ReadFile(jpgPath)
+	if err != nil {
+		t.Fatalf("Failed to read JPEG: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Delete.Mode = config.DeleteModeQuarantine
+	cfg.Process.TargetMegapixels = 0.001
+	cfg.Process.JournalBackup = true
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	if err := proc.Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if !proc.Journaled() {
+		t.Fatal("Run should have been journaled")
+	}
+	if checkFileExists(t, rawPath) {
+		t.Fatal("RAW should have been deleted")
+	}
+
+	restored, errs := journal.Undo(journal.Open(journal.Dir(tmpDir), proc.RunID()).Path())
+	if len(errs) > 0 || restored != 2 {
+		t.Fatalf("Undo() restored %d, errors %v", restored, errs)
+	}
+	if !checkFileExists(t, rawPath) {
+		t.Error("RAW was not restored")
+	}
+	if data, _ := os.ReadFile(jpgPath); !bytes.Equal(data, original) {
+		t.Error("Original JPEG was not restored")
+	}
+}
+
+func TestRemoveModeIsPermanent(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img1.JPG")
+	rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+	if err := createTestFiles(t, jpgPath, rawPath, 2); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Delete.Mode = config.DeleteModeRemove
+	cfg.Process.TargetMegapixels = 0.001
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	if err := proc.Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if checkFileExists(t, rawPath) {
+		t.Fatal("RAW should have been deleted")
+	}
+
+	// Neither the RAW nor the compressed original may be kept anywhere
+	backups := filepath.Join(journal.Dir(tmpDir), proc.RunID())
+	if checkFileExists(t, backups) {
+		t.Errorf("Backup folder %s should not exist", backups)
+	}
+
+	restored, errs := journal.Undo(journal.Open(journal.Dir(tmpDir), proc.RunID()).Path())
+	if restored != 0 || len(errs) != 2 {
+		t.Errorf("Undo() restored %d, errors %v, want 2 unrecoverable entries", restored, errs)
+	}
+}
+
+func TestKeepOriginalAndRestore(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img1.JPG")
+	rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+	if err := createTestFiles(t, jpgPath, rawPath, 2); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+	original, err := os.ReadFile(jpgPath)
+	if err != nil {
+		t.Fatalf("Failed to read JPEG: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Process.TargetMegapixels = 0.001
+	cfg.Process.KeepOriginal.Enabled = true
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	if err := proc.Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	archived := filepath.Join(tmpDir, ".originals", "img1.JPG")
+	if data, _ := os.ReadFile(archived); !bytes.Equal(data, original) {
+		t.Fatal("Original was not archived")
+	}
+
+	// Still rated for compression, nothing to restore
+	restored, err := proc.RestoreOriginals(false)
+	if err != nil || restored != 0 {
+		t.Fatalf("RestoreOriginals() = %d, %v, want 0", restored, err)
+	}
+
+	// Upgrade the rating of the compressed JPEG
+	if err := testutils.CreateTestJPEGWithEmbeddedXMP(t, jpgPath, 4); err != nil {
+		t.Fatalf("Failed to update rating: %v", err)
+	}
+	restored, err = proc.RestoreOriginals(false)
+	if err != nil || restored != 1 {
+		t.Fatalf("RestoreOriginals() = %d, %v, want 1", restored, err)
+	}
+	if data, _ := os.ReadFile(jpgPath); !bytes.Equal(data, original) {
+		t.Error("Original was not restored")
+	}
+}
+
+func TestSafetyLimits(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"img1", "img2"} {
+		jpgPath := filepath.Join(tmpDir, name+".JPG")
+		rawPath := filepath.Join(tmpDir, "raw", name+".RAF")
+		if err := createTestFiles(t, jpgPath, rawPath, 1); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Limits.MaxRawDeletePercentPerFolder = 50
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	err := proc.Process()
+	if err == nil || !strings.Contains(err.Error(), "2 of 2 RAWs") {
+		t.Fatalf("Process() error = %v, want limit violation", err)
+	}
+
+	// Nothing may be deleted once a limit is crossed
+	for _, name := range []string{"img1", "img2"} {
+		if !checkFileExists(t, filepath.Join(tmpDir, "raw", name+".RAF")) {
+			t.Errorf("%s.RAF was deleted despite the limit", name)
+		}
+		if !checkFileExists(t, filepath.Join(tmpDir, name+".JPG")) {
+			t.Errorf("%s.JPG was deleted despite the limit", name)
+		}
+	}
+}
+
+func TestProtectionMarkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		protect func(t *testing.T, dir, jpgPath, rawPath string)
+		cfg     func(cfg *config.Config)
+	}{
+		{
+			name: "Folder marker",
+			protect: func(t *testing.T, dir, jpgPath, rawPath string) {
+				if err := os.WriteFile(filepath.Join(dir, config.KeepMarker), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "File markers",
+			protect: func(t *testing.T, dir, jpgPath, rawPath string) {
+				for _, path := range []string{jpgPath, rawPath} {
+					if err := os.WriteFile(path+config.KeepMarker, nil, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+		},
+		{
+			name: "Read-only bit",
+			protect: func(t *testing.T, dir, jpgPath, rawPath string) {
+				for _, path := range []string{jpgPath, rawPath} {
+					if err := os.Chmod(path, 0444); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+		},
+		{
+			name: "XMP keyword",
+			protect: func(t *testing.T, dir, jpgPath, rawPath string) {
+				xmpContent := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+  <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+    <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+      <xmp:Rating>1</xmp:Rating>
+      <dc:subject><rdf:Bag><rdf:li>Portfolio</rdf:li></rdf:Bag></dc:subject>
+    </rdf:Description>
+  </rdf:RDF>
+</x:xmpmeta>`
+				if err := os.WriteFile(strings.TrimSuffix(jpgPath, ".JPG")+".xmp", []byte(xmpContent), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			cfg: func(cfg *config.Config) {
+				cfg.Xmp.Mode = config.XmpModeSeparate
+				cfg.Protect.Keywords = []string{"portfolio"}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			jpgPath := filepath.Join(tmpDir, "img1.JPG")
+			rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+			if err := createTestFiles(t, jpgPath, rawPath, 1); err != nil {
+				t.Fatalf("Failed to create test files: %v", err)
+			}
+			tt.protect(t, tmpDir, jpgPath, rawPath)
+
+			cfg := config.NewDefaultConfig()
+			if tt.cfg != nil {
+				tt.cfg(cfg)
+			}
+			proc := NewImageProcessor(tmpDir, cfg, false)
+			pl, err := proc.Plan(false)
+			if err != nil {
+				t.Fatalf("Plan() error = %v", err)
+			}
+			if len(pl.Entries) != 0 || len(pl.Skipped) != 2 {
+				t.Errorf("Plan entries = %+v, skipped = %+v", pl.Entries, pl.Skipped)
+			}
+			// The summary names each skipped file and what protects it
+			for _, skip := range pl.Skipped {
+				if line := skip.File + ": " + skip.Reason; !strings.Contains(pl.Summary(), line) || !strings.Contains(skip.Reason, "protected by") {
+					t.Errorf("Summary() lacks %q:\n%s", line, pl.Summary())
+				}
+			}
+			if err := proc.Apply(pl); err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if !checkFileExists(t, jpgPath) || !checkFileExists(t, rawPath) {
+				t.Error("Protected files were deleted")
+			}
+		})
+	}
+}
+
+func TestProtectionVetoesApply(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img1.JPG")
+	rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+	if err := createTestFiles(t, jpgPath, rawPath, 1); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+
+	proc := NewImageProcessor(tmpDir, config.NewDefaultConfig(), false)
+	pl, err := proc.Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	// A marker added after planning still protects the folder
+	if err := os.WriteFile(filepath.Join(tmpDir, "raw", config.KeepMarker), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := proc.Apply(pl); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !checkFileExists(t, rawPath) {
+		t.Error("Protected RAW was deleted")
+	}
+	if checkFileExists(t, jpgPath) {
+		t.Error("Unprotected JPEG should have been deleted")
+	}
+	marker := filepath.Join(tmpDir, "raw", config.KeepMarker)
+	if summary := proc.Summary(); !strings.Contains(summary, rawPath+": delete refused, protected by "+marker) {
+		t.Errorf("Summary() does not name the protected RAW and its marker:\n%s", summary)
+	}
+}
+
+func TestXmpProtectionVetoesApply(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img1.JPG")
+	rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+	if err := createTestFiles(t, jpgPath, rawPath, 1); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+	writeSidecar(t, jpgPath, "<xmp:Rating>1</xmp:Rating>")
+	// img2 is not protected, its RAW is deleted and its JPEG compressed
+	jpg2Path := filepath.Join(tmpDir, "img2.JPG")
+	if err := createTestFiles(t, jpg2Path, filepath.Join(tmpDir, "raw", "img2.RAF"), 2); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+	writeSidecar(t, jpg2Path, "<xmp:Rating>2</xmp:Rating>")
+
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeSeparate
+	cfg.Protect.Keywords = []string{"portfolio"}
+	cfg.Process.TargetMegapixels = 0.001
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	pl, err := proc.Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	// A protected keyword added after planning vetoes the pair's actions
+	writeSidecar(t, jpgPath, "<xmp:Rating>1</xmp:Rating><dc:subject><rdf:Bag><rdf:li>Portfolio</rdf:li></rdf:Bag></dc:subject>")
+	if err := proc.Apply(pl); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !checkFileExists(t, rawPath) || !checkFileExists(t, jpgPath) {
+		t.Error("Files protected after planning were deleted")
+	}
+	if checkFileExists(t, filepath.Join(tmpDir, "raw", "img2.RAF")) {
+		t.Error("Unprotected RAW should have been deleted")
+	}
+	if !pl.Has(jpg2Path, plan.ActionCompress) || !proc.Journaled() {
+		t.Error("Unprotected JPEG should have been compressed")
+	}
+}
+
+func TestOrphanPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		orphan    config.OrphanConfig
+		firstSeen time.Duration
+		wantKept  bool
+		wantMoved bool
+	}{
+		{
+			name:     "Keep",
+			orphan:   config.OrphanConfig{Action: config.OrphanKeep},
+			wantKept: true,
+		},
+		{
+			name:     "Delete",
+			orphan:   config.OrphanConfig{Action: config.OrphanDelete},
+			wantKept: false,
+		},
+		{
+			name:      "Move",
+			orphan:    config.OrphanConfig{Action: config.OrphanMove, MoveTo: config.DefaultOrphanDir},
+			wantKept:  false,
+			wantMoved: true,
+		},
+		{
+			name:     "Delete after days, orphaned recently",
+			orphan:   config.OrphanConfig{Action: config.OrphanDelete, AfterDays: 7},
+			wantKept: true,
+		},
+		{
+			name:      "Delete after days, orphaned long ago",
+			orphan:    config.OrphanConfig{Action: config.OrphanDelete, AfterDays: 7},
+			firstSeen: 8 * 24 * time.Hour,
+			wantKept:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+			if err := os.MkdirAll(filepath.Dir(rawPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(rawPath, []byte("RAW"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.firstSeen > 0 {
+				st, err := state.Load(tmpDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				st.SeenOrphan(filepath.Join("raw", "img1.RAF"), time.Now().Add(-tt.firstSeen))
+				if err := st.Save(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg := config.NewDefaultConfig()
+			cfg.Orphan = tt.orphan
+			proc := NewImageProcessor(tmpDir, cfg, false)
+			if err := proc.Process(); err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+
+			if exists := checkFileExists(t, rawPath); exists != tt.wantKept {
+				t.Errorf("RAW exists = %v, want %v", exists, tt.wantKept)
+			}
+			moved := checkFileExists(t, filepath.Join(tmpDir, config.DefaultOrphanDir, "raw", "img1.RAF"))
+			if moved != tt.wantMoved {
+				t.Errorf("RAW moved = %v, want %v", moved, tt.wantMoved)
+			}
+
+			// The first-seen time is recorded for orphans that are kept
+			st, err := state.Load(tmpDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, exists := st.Orphans[filepath.Join("raw", "img1.RAF")]; !exists {
+				t.Error("Orphan was not recorded in the state file")
+			}
+		})
+	}
+}
+
+func TestNoJpegActionFallback(t *testing.T) {
+	tmpDir := t.TempDir()
+	rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+	if err := os.MkdirAll(filepath.Dir(rawPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rawPath, []byte("RAW"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an orphan action the RAW path honors noJpegAction as well
+	cfg := config.NewDefaultConfig()
+	cfg.Orphan.Action = ""
+	cfg.NoJpegAction.DeleteRaw = false
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	if err := proc.Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if !checkFileExists(t, rawPath) {
+		t.Error("RAW was deleted although noJpegAction keeps it")
+	}
+}
+
+func TestIncrementalRun(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]int{"img1": 2, "img2": 3, "img3": 4}
+	for name, rating := range files {
+		jpgPath := filepath.Join(tmpDir, name+".JPG")
+		rawPath := filepath.Join(tmpDir, "raw", name+".RAF")
+		if err := createTestFiles(t, jpgPath, rawPath, rating); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+	}
+
+	cfg := config.NewDefaultConfig()
+	if err := NewImageProcessor(tmpDir, cfg, false).Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	// Nothing changed, no rating has to be read again
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	pl, err := proc.Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if pl.Stats.RatingReads != 0 || pl.Stats.Unchanged != 2 {
+		t.Errorf("Second run read %d ratings, skipped %d, want 0 and 2", pl.Stats.RatingReads, pl.Stats.Unchanged)
+	}
+
+	// A changed JPEG is evaluated again
+	if err := testutils.CreateTestJPEGWithEmbeddedXMP(t, filepath.Join(tmpDir, "img3.JPG"), 1); err != nil {
+		t.Fatalf("Failed to update rating: %v", err)
+	}
+	proc = NewImageProcessor(tmpDir, cfg, false)
+	if err := proc.Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if checkFileExists(t, filepath.Join(tmpDir, "raw", "img3.RAF")) {
+		t.Error("RAW of the re-rated JPEG should have been deleted")
+	}
+
+	// A full run evaluates every pair and keeps the stored results
+	proc = NewImageProcessor(tmpDir, cfg, false)
+	proc.Full = true
+	if pl, err = proc.Plan(false); err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if pl.Stats.RatingReads != 1 || pl.Stats.Unchanged != 0 {
+		t.Errorf("Full run read %d ratings, skipped %d, want 1 and 0", pl.Stats.RatingReads, pl.Stats.Unchanged)
+	}
+	if pl, err = NewImageProcessor(tmpDir, cfg, false).Plan(false); err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if pl.Stats.RatingReads != 0 {
+		t.Errorf("Run after the full run read %d ratings, want 0", pl.Stats.RatingReads)
+	}
+
+	// Disabling incremental runs evaluates every pair
+	cfg.Incremental = false
+	pl, err = NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if pl.Stats.RatingReads != 1 {
+		t.Errorf("Full run read %d ratings, want 1", pl.Stats.RatingReads)
+	}
+}
+
+func TestRejectedRating(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]int{"img1": -1, "img2": 1, "img3": 4}
+	for name, rating := range files {
+		jpgPath := filepath.Join(tmpDir, name+".JPG")
+		rawPath := filepath.Join(tmpDir, "raw", name+".RAF")
+		if err := createTestFiles(t, jpgPath, rawPath, rating); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.RatingActions[1] = config.Action{CompressJpeg: true}
+	cfg.RejectAction = config.Action{DeleteRaw: true}
+
+	pl, err := NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if pl.Stats.Ratings[config.RejectedRating] != 1 || pl.Stats.Ratings[1] != 1 {
+		t.Errorf("Ratings = %v, want rejected and 1 star counted apart", pl.Stats.Ratings)
+	}
+	if len(pl.Entries) != 2 {
+		t.Fatalf("Plan has %d entries, want 2: %+v", len(pl.Entries), pl.Entries)
+	}
+	for _, e := range pl.Entries {
+		switch e.File {
+		case filepath.Join(tmpDir, "raw", "img1.RAF"):
+			if e.Action != plan.ActionDelete || e.Reason != "Rejected" {
+				t.Errorf("Unexpected entry for rejected RAW: %+v", e)
+			}
+		case filepath.Join(tmpDir, "img2.JPG"):
+			if e.Action != plan.ActionCompress {
+				t.Errorf("Unexpected entry for 1 star JPEG: %+v", e)
+			}
+		default:
+			t.Errorf("Unexpected entry: %+v", e)
+		}
+	}
+	if summary := pl.Summary(); !strings.Contains(summary, "rejected: 1") || !strings.Contains(summary, "delete:   1 (1 rejected)") {
+		t.Errorf("Summary() does not report rejects separately:\n%s", summary)
+	}
+}
+
+// writeSidecar writes a .xmp sidecar for jpgPath with the given rdf:Description properties
+func writeSidecar(t *testing.T, jpgPath, properties string) {
+	t.Helper()
+	xmpContent := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+  <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+    <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/"
+        xmlns:xmpDM="http://ns.adobe.com/xmp/1.0/DynamicMedia/" xmlns:digiKam="http://www.digikam.org/ns/1.0/"
+        xmlns:lr="http://ns.adobe.com/lightroom/1.0/">
+      ` + properties + `
+    </rdf:Description>
+  </rdf:RDF>
+</x:xmpmeta>`
+	if err := os.WriteFile(strings.TrimSuffix(jpgPath, ".JPG")+".xmp", []byte(xmpContent), 0644); err != nil {
+		t.Fatalf("Failed to write sidecar: %v", err)
+	}
+}
+
+func TestLabelActions(t *testing.T) {
+	tmpDir := t.TempDir()
+	sidecars := map[string]string{
+		"img1": `<xmp:Rating>1</xmp:Rating><xmp:Label>Green</xmp:Label>`,
+		"img2": `<xmp:Label>Red</xmp:Label>`,
+		"img3": `<xmp:Rating>-1</xmp:Rating><xmp:Label>Green</xmp:Label>`,
+		"img4": `<xmp:Rating>4</xmp:Rating>`,
+	}
+	for name, properties := range sidecars {
+		jpgPath := filepath.Join(tmpDir, name+".JPG")
+		if err := createTestFiles(t, jpgPath, filepath.Join(tmpDir, "raw", name+".RAF"), 0); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+		writeSidecar(t, jpgPath, properties)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeSeparate
+	cfg.RejectAction = config.Action{DeleteRaw: true, DeleteJpeg: true}
+	cfg.LabelActions = map[string]config.Action{
+		"red":   {DeleteRaw: true},
+		"Green": {},
+	}
+
+	pl, err := NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	got := map[string]string{}
+	for _, e := range pl.Entries {
+		rel, _ := filepath.Rel(tmpDir, e.File)
+		got[rel] = string(e.Action) + " (" + e.Reason + ")"
+	}
+	want := map[string]string{
+		// Unrated but labeled red
+		filepath.Join("raw", "img2.RAF"): "delete (Label Red)",
+		// Rejects win over labels
+		filepath.Join("raw", "img3.RAF"): "delete (Rejected)",
+		"img3.JPG":                       "delete (Rejected)",
+	}
+	if len(got) != len(want) {
+		t.Errorf("Plan entries = %v, want %v", got, want)
+	}
+	for file, action := range want {
+		if got[file] != action {
+			t.Errorf("%s: got %q, want %q", file, got[file], action)
+		}
+	}
+	if pl.Stats.RatingErrors != 0 {
+		t.Errorf("RatingErrors = %d, want 0", pl.Stats.RatingErrors)
+	}
+}
+
+func TestPickActions(t *testing.T) {
+	tmpDir := t.TempDir()
+	sidecars := map[string]string{
+		"img1": `<xmpDM:pick>1</xmpDM:pick><xmp:Label>Red</xmp:Label>`,
+		"img2": `<digiKam:PickLabel>1</digiKam:PickLabel><xmp:Rating>5</xmp:Rating>`,
+		"img3": `<xmp:Rating>4</xmp:Rating>`,
+		"img4": `<xmp:Rating>-1</xmp:Rating><xmpDM:pick>1</xmpDM:pick>`,
+	}
+	for name, properties := range sidecars {
+		jpgPath := filepath.Join(tmpDir, name+".JPG")
+		if err := createTestFiles(t, jpgPath, filepath.Join(tmpDir, "raw", name+".RAF"), 0); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+		writeSidecar(t, jpgPath, properties)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeSeparate
+	cfg.RejectAction = config.Action{DeleteRaw: true, DeleteJpeg: true}
+	cfg.LabelActions = map[string]config.Action{"Red": {DeleteRaw: true}}
+	cfg.PickActions = config.PickActions{
+		Picked:   &config.Action{},
+		Rejected: &config.Action{DeleteRaw: true},
+	}
+
+	pl, err := NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	got := map[string]string{}
+	for _, e := range pl.Entries {
+		rel, _ := filepath.Rel(tmpDir, e.File)
+		got[rel] = string(e.Action) + " (" + e.Reason + ")"
+	}
+	want := map[string]string{
+		// Reject flag wins over 5 stars
+		filepath.Join("raw", "img2.RAF"): "delete (Flagged rejected)",
+		// Rejected rating wins over the pick flag
+		filepath.Join("raw", "img4.RAF"): "delete (Rejected)",
+		"img4.JPG":                       "delete (Rejected)",
+	}
+	if len(got) != len(want) {
+		t.Errorf("Plan entries = %v, want %v", got, want)
+	}
+	for file, action := range want {
+		if got[file] != action {
+			t.Errorf("%s: got %q, want %q", file, got[file], action)
+		}
+	}
+}
+
+func TestKeywordRules(t *testing.T) {
+	tmpDir := t.TempDir()
+	sidecars := map[string]string{
+		"img1": `<xmp:Rating>1</xmp:Rating><dc:subject><rdf:Bag><rdf:li>Portfolio</rdf:li></rdf:Bag></dc:subject>`,
+		"img2": `<xmp:Rating>4</xmp:Rating><dc:subject><rdf:Bag><rdf:li>web-only</rdf:li></rdf:Bag></dc:subject>`,
+		"img3": `<xmp:Rating>1</xmp:Rating><lr:hierarchicalSubject><rdf:Bag><rdf:li>Clients|delivered</rdf:li></rdf:Bag></lr:hierarchicalSubject>`,
+		"img4": `<xmp:Rating>2</xmp:Rating><dc:subject><rdf:Bag><rdf:li>web-only</rdf:li><rdf:li>print</rdf:li></rdf:Bag></dc:subject>`,
+	}
+	for name, properties := range sidecars {
+		jpgPath := filepath.Join(tmpDir, name+".JPG")
+		if err := createTestFiles(t, jpgPath, filepath.Join(tmpDir, "raw", name+".RAF"), 0); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+		writeSidecar(t, jpgPath, properties)
+	}
+
+	never, always := false, true
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeSeparate
+	cfg.KeywordRules = []config.KeywordRule{
+		{Keywords: []string{"portfolio", "print", "Clients|delivered"}, DeleteRaw: &never, DeleteJpeg: &never, CompressJpeg: &never},
+		{Keywords: []string{"web-only"}, CompressJpeg: &always},
+	}
+
+	pl, err := NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	got := map[string]string{}
+	for _, e := range pl.Entries {
+		rel, _ := filepath.Rel(tmpDir, e.File)
+		got[rel] = string(e.Action) + " (" + e.Reason + ")"
+	}
+	want := map[string]string{
+		// 4 stars, but web-only forces compression
+		"img2.JPG": "compress (Rating 4, keyword web-only)",
+		// img4: web-only and print disagree, keeping wins
+	}
+	if len(got) != len(want) {
+		t.Errorf("Plan entries = %v, want %v", got, want)
+	}
+	for file, action := range want {
+		if got[file] != action {
+			t.Errorf("%s: got %q, want %q", file, got[file], action)
+		}
+	}
+}
+
+func TestRawOnlyMode(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"img1", "img2", "img3"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name+".RAF"), []byte("RAW"), 0644); err != nil {
+			t.Fatalf("Failed to create RAW: %v", err)
+		}
+	}
+	// darktable and Lightroom naming
+	if err := testutils.CreateTestXMP(t, filepath.Join(tmpDir, "img1.RAF.xmp"), 1); err != nil {
+		t.Fatalf("Failed to create sidecar: %v", err)
+	}
+	if err := testutils.CreateTestXMP(t, filepath.Join(tmpDir, "img2.xmp"), 4); err != nil {
+		t.Fatalf("Failed to create sidecar: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Files.SameDir = true
+	cfg.Files.RawOnly = true
+
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	pl, err := proc.Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(pl.Entries) != 2 {
+		t.Fatalf("Plan has %d entries, want RAW and sidecar of img1: %+v", len(pl.Entries), pl.Entries)
+	}
+	if err := proc.Apply(pl); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	for file, want := range map[string]bool{
+		"img1.RAF":     false,
+		"img1.RAF.xmp": false,
+		"img2.RAF":     true,
+		"img2.xmp":     true,
+		// RAWs without JPEG are no orphans in RAW-only mode
+		"img3.RAF": true,
+	} {
+		if got := checkFileExists(t, filepath.Join(tmpDir, file)); got != want {
+			t.Errorf("%s exists = %v, want %v", file, got, want)
+		}
+	}
+
+	// The second run skips the unchanged RAW
+	pl, err = NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if pl.Stats.RatingReads != 0 || pl.Stats.Unchanged != 1 {
+		t.Errorf("Second run read %d ratings, skipped %d, want 0 and 1", pl.Stats.RatingReads, pl.Stats.Unchanged)
+	}
+}
+
+func TestWriteRawSidecar(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"img1", "img2", "img3"} {
+		if err := createTestFiles(t, filepath.Join(tmpDir, name+".JPG"), filepath.Join(tmpDir, "raw", name+".RAF"), 0); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+	}
+	writeSidecar(t, filepath.Join(tmpDir, "img1.JPG"), `<xmp:Rating>4</xmp:Rating><xmp:Label>Green</xmp:Label>
+      <dc:subject><rdf:Bag><rdf:li>print</rdf:li></rdf:Bag></dc:subject>`)
+	writeSidecar(t, filepath.Join(tmpDir, "img2.JPG"), `<xmp:Rating>5</xmp:Rating>`)
+	writeSidecar(t, filepath.Join(tmpDir, "img3.JPG"), `<xmp:Rating>1</xmp:Rating>`)
+
+	// An existing sidecar of img2 with edits of the RAW editor
+	existing := filepath.Join(tmpDir, "raw", "img2.RAF.xmp")
+	if err := os.WriteFile(existing, []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:darktable="http://darktable.sf.net/"
+    xmp:Rating="1" darktable:history_end="3"/>
+ </rdf:RDF>
+</x:xmpmeta>`), 0644); err != nil {
+		t.Fatalf("Failed to write sidecar: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeSeparate
+	cfg.Delete.Mode = config.DeleteModeQuarantine
+	cfg.RawSidecar.Write = true
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	if err := proc.Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	meta, err := xmp.GetMetadataFromFile(filepath.Join(tmpDir, "raw", "img1.RAF.xmp"))
+	if err != nil {
+		t.Fatalf("Sidecar of img1 was not written: %v", err)
+	}
+	if meta.Rating != 4 || meta.Label != "Green" || !meta.HasKeyword("print") {
+		t.Errorf("Sidecar of img1 = %+v, want rating 4, label Green and keyword print", meta)
+	}
+	data, err := os.ReadFile(existing)
+	if err != nil {
+		t.Fatalf("Failed to read sidecar: %v", err)
+	}
+	if meta, _ := xmp.GetMetadata(data); meta == nil || meta.Rating != 5 || !strings.Contains(string(data), `darktable:history_end="3"`) {
+		t.Errorf("Sidecar of img2 was not updated in place:\n%s", data)
+	}
+	// Deleted RAWs get no sidecar
+	if checkFileExists(t, filepath.Join(tmpDir, "raw", "img3.RAF.xmp")) {
+		t.Error("Sidecar of deleted RAW img3 was written")
+	}
+
+	// Undo removes new sidecars and restores existing ones
+	if _, errs := journal.Undo(journal.Open(journal.Dir(tmpDir), proc.RunID()).Path()); len(errs) > 0 {
+		t.Fatalf("Undo() errors %v", errs)
+	}
+	if checkFileExists(t, filepath.Join(tmpDir, "raw", "img1.RAF.xmp")) {
+		t.Error("Created sidecar of img1 was not removed")
+	}
+	if data, _ := os.ReadFile(existing); !strings.Contains(string(data), `xmp:Rating="1"`) {
+		t.Errorf("Sidecar of img2 was not restored:\n%s", data)
+	}
+}
+
+func TestWriteRawSidecarFromRawSources(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img1.JPG")
+	rawPath := filepath.Join(tmpDir, "raw", "img1.RAF")
+	if err := createTestFiles(t, jpgPath, rawPath, 2); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+	// Only the RAW's profile carries the rating
+	if err := os.WriteFile(rawPath+".pp3", []byte("[General]\nRank=4\n"), 0644); err != nil {
+		t.Fatalf("Failed to write profile: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeRawTherapee
+	cfg.RawSidecar.Write = true
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	pl, err := proc.Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if err := proc.Apply(pl); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	meta, err := xmp.GetMetadataFromFile(rawPath + ".xmp")
+	if err != nil {
+		t.Fatalf("Sidecar was not written: %v", err)
+	}
+	if meta.Rating != 4 {
+		t.Errorf("Sidecar rating = %d, want the planned rating 4", meta.Rating)
+	}
+	// The sidecar is replaced without leaving a temporary file behind
+	if temps, _ := filepath.Glob(filepath.Join(tmpDir, "raw", ".rawmanager-*.tmp")); len(temps) > 0 {
+		t.Errorf("Temporary files left behind: %v", temps)
+	}
+}
+
+func TestRawSidecarNaming(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := createTestFiles(t, filepath.Join(tmpDir, "img1.JPG"), filepath.Join(tmpDir, "raw", "img1.RAF"), 3); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.RawSidecar.Write = true
+	cfg.RawSidecar.Naming = config.SidecarNamingBase
+	if err := NewImageProcessor(tmpDir, cfg, false).Process(); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if rating, err := xmp.GetRatingFromFile(filepath.Join(tmpDir, "raw", "img1.xmp")); err != nil || rating != 3 {
+		t.Errorf("Sidecar rating = %d, %v, want 3", rating, err)
+	}
+	if checkFileExists(t, filepath.Join(tmpDir, "raw", "img1.RAF.xmp")) {
+		t.Error("Sidecar was written with ext naming")
+	}
+}
+
+func TestAutoModeConflicts(t *testing.T) {
+	tmpDir := t.TempDir()
+	ratings := map[string][2]int{
+		"img1": {1, 1}, // Agreeing sources
+		"img2": {1, 4}, // Disagreeing sources
+	}
+	for name, r := range ratings {
+		jpgPath := filepath.Join(tmpDir, name+".JPG")
+		if err := createTestFiles(t, jpgPath, filepath.Join(tmpDir, "raw", name+".RAF"), r[0]); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+		writeSidecar(t, jpgPath, fmt.Sprintf("<xmp:Rating>%d</xmp:Rating>", r[1]))
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeAuto
+	pl, err := NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(pl.Conflicts) != 1 || pl.Conflicts[0].Resolution != "skipped" || pl.Conflicts[0].Ratings["separate"] != 4 {
+		t.Fatalf("Conflicts = %+v, want img2 skipped", pl.Conflicts)
+	}
+	for _, e := range pl.Entries {
+		if strings.Contains(e.File, "img2") {
+			t.Errorf("Conflicting pair was planned: %+v", e)
+		}
+	}
+	if len(pl.Entries) != 2 {
+		t.Errorf("Plan has %d entries, want RAW and JPEG of img1", len(pl.Entries))
+	}
+
+	// The lowest rating deletes the conflicting pair as well
+	cfg.Xmp.Conflict = config.ConflictLowest
+	pl, err = NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(pl.Conflicts) != 1 || pl.Conflicts[0].Resolution != "lowest: 1" || len(pl.Entries) != 4 {
+		t.Errorf("Conflicts = %+v with %d entries, want img2 resolved to 1 and 4 entries", pl.Conflicts, len(pl.Entries))
+	}
+}
+
+func TestRatingScales(t *testing.T) {
+	tmpDir := t.TempDir()
+	sidecars := map[string]string{
+		"img1": `<MicrosoftPhoto:Rating xmlns:MicrosoftPhoto="http://ns.microsoft.com/photo/1.0/">75</MicrosoftPhoto:Rating>`,
+		"img2": `<xmp:Rating>3</xmp:Rating>`,
+	}
+	for name, properties := range sidecars {
+		jpgPath := filepath.Join(tmpDir, name+".JPG")
+		if err := createTestFiles(t, jpgPath, filepath.Join(tmpDir, "raw", name+".RAF"), 0); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+		writeSidecar(t, jpgPath, properties)
+	}
+
+	// Windows writes 75 for 4 stars
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeSeparate
+	pl, err := NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(pl.Entries) != 0 || pl.Stats.Ratings[4] != 1 {
+		t.Errorf("Plan has %d entries and ratings %v, want img1 rated 4 without actions", len(pl.Entries), pl.Stats.Ratings)
+	}
+	if len(pl.Normalized) != 1 || pl.Normalized[0].Scale != "microsoft" || pl.Normalized[0].Percent != 75 || pl.Normalized[0].Rating != 4 {
+		t.Errorf("Normalized = %+v, want img1 from 75%% on the microsoft scale", pl.Normalized)
+	}
+	if pl.Stats.Scales["microsoft"] != 1 || pl.Stats.Scales["stars"] != 1 {
+		t.Errorf("Scales = %v, want one microsoft and one stars rating", pl.Stats.Scales)
+	}
+	if !strings.Contains(pl.Summary(), "microsoft:") {
+		t.Errorf("Summary() = %q, want the rating scales", pl.Summary())
+	}
+
+	// A configured table replaces the Windows buckets, including 100 which
+	// lies outside of them
+	jpg3Path := filepath.Join(tmpDir, "img3.JPG")
+	if err := createTestFiles(t, jpg3Path, filepath.Join(tmpDir, "raw", "img3.RAF"), 0); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+	writeSidecar(t, jpg3Path, `<MicrosoftPhoto:Rating xmlns:MicrosoftPhoto="http://ns.microsoft.com/photo/1.0/">100</MicrosoftPhoto:Rating>`)
+	cfg.Xmp.Scales = map[string]rating.Scale{"microsoft": {{Min: 1, Max: 80, Stars: 1}, {Min: 81, Max: 100, Stars: 5}}}
+	pl, err = NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(pl.Entries) != 2 || pl.Stats.RatingErrors != 0 {
+		t.Errorf("Plan has %d entries and %d rating errors, want img1 deleted", len(pl.Entries), pl.Stats.RatingErrors)
+	}
+	for _, n := range pl.Normalized {
+		if want := map[int]int{75: 1, 100: 5}[n.Percent]; n.Rating != want {
+			t.Errorf("Normalized %+v, want %d stars", n, want)
+		}
+	}
+	if pl.Stats.Ratings[5] != 1 {
+		t.Errorf("Ratings = %v, want img3 rated 5", pl.Stats.Ratings)
+	}
+}
+
+func TestHeifCompanion(t *testing.T) {
+	tmpDir := t.TempDir()
+	ratings := map[string]int{"img1.HIF": 1, "img2.HIF": 2, "img3.HEIC": 3}
+	for name, rating := range ratings {
+		if err := testutils.CreateTestHEIFWithXMP(t, filepath.Join(tmpDir, name), rating, false); err != nil {
+			t.Fatalf("Failed to create test HEIF: %v", err)
+		}
+		rawPath := filepath.Join(tmpDir, "raw", strings.TrimSuffix(name, filepath.Ext(name))+".RAF")
+		if err := os.MkdirAll(filepath.Dir(rawPath), 0755); err != nil {
+			t.Fatalf("Failed to create RAW directory: %v", err)
+		}
+		if err := os.WriteFile(rawPath, []byte("RAW"), 0644); err != nil {
+			t.Fatalf("Failed to create test RAW: %v", err)
+		}
+	}
+
+	cfg := config.NewDefaultConfig()
+	pl, err := NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	// img1 is deleted, img2 loses its RAW but is not compressed, img3 is kept
+	planned := map[string]plan.Action{}
+	for _, e := range pl.Entries {
+		planned[filepath.Base(e.File)] = e.Action
+	}
+	want := map[string]plan.Action{"img1.HIF": plan.ActionDelete, "img1.RAF": plan.ActionDelete, "img2.RAF": plan.ActionDelete}
+	if len(planned) != len(want) {
+		t.Errorf("Planned %v, want %v", planned, want)
+	}
+	for file, action := range want {
+		if planned[file] != action {
+			t.Errorf("Action of %s = %q, want %q", file, planned[file], action)
+		}
+	}
+	if pl.Stats.Ratings[3] != 1 {
+		t.Errorf("Ratings = %v, want img3 rated 3", pl.Stats.Ratings)
+	}
+
+	// Without HEIF extensions the RAWs are orphans
+	cfg.Files.HeifExtensions = nil
+	cfg.Orphan.Action = config.OrphanKeep
+	pl, err = NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(pl.Entries) != 0 || len(pl.Stats.Ratings) != 0 {
+		t.Errorf("Plan has %d entries and ratings %v, want HEIFs ignored", len(pl.Entries), pl.Stats.Ratings)
+	}
+}
+
+func TestPairingByDirectoryListing(t *testing.T) {
+	tmpDir := t.TempDir()
+	// Extensions in mixed case pair as well
+	if err := createTestFiles(t, filepath.Join(tmpDir, "img1.Jpg"), filepath.Join(tmpDir, "raw", "img1.RAF"), 4); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+	// Both RAWs sharing the JPEG's name form a pair with it
+	if err := createTestFiles(t, filepath.Join(tmpDir, "img2.JPG"), filepath.Join(tmpDir, "raw", "img2.RAF"), 1); err != nil {
+		t.Fatalf("Failed to create test files: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "raw", "img2.DNG"), []byte("RAW"), 0644); err != nil {
+		t.Fatalf("Failed to create test RAW: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Files.RawExtension = config.Extensions{".RAF", ".DNG"}
+	cfg.Protect.Labels = []string{"Red"}
+	proc := NewImageProcessor(tmpDir, cfg, false)
+	pl, err := proc.Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if pl.Stats.Ratings[4] != 1 || pl.Stats.Ratings[1] != 2 {
+		t.Errorf("Ratings = %v, want img1 and both RAWs of img2 paired", pl.Stats.Ratings)
+	}
+	for _, e := range pl.Entries {
+		if e.Reason != "Rating 1" {
+			t.Errorf("Unexpected entry %+v, RAWs with a JPEG are no orphans", e)
+		}
+	}
+
+	if err := proc.Apply(pl); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	for _, name := range []string{"img2.JPG", "raw/img2.RAF", "raw/img2.DNG"} {
+		if checkFileExists(t, filepath.Join(tmpDir, name)) {
+			t.Errorf("%s should have been deleted", name)
+		}
+	}
+	if !checkFileExists(t, filepath.Join(tmpDir, "raw", "img1.RAF")) {
+		t.Error("RAW of img1.Jpg should have been kept")
+	}
+}
+
+func TestMultipleExtensions(t *testing.T) {
+	tmpDir := t.TempDir()
+	pairs := []struct {
+		jpg, raw string
+		rating   int
+	}{
+		{jpg: "img1.JPG", raw: "img1.RAF", rating: 1},
+		{jpg: "img2.jpeg", raw: "img2.CR3", rating: 1},
+		{jpg: "img3.jpg", raw: "img3.nef", rating: 4},
+	}
+	for _, pair := range pairs {
+		if err := createTestFiles(t, filepath.Join(tmpDir, pair.jpg), filepath.Join(tmpDir, "raw", pair.raw), pair.rating); err != nil {
+			t.Fatalf("Failed to create test files: %v", err)
+		}
+	}
+	// A RAW without any companion is still an orphan
+	if err := os.WriteFile(filepath.Join(tmpDir, "raw", "img4.ARW"), []byte("RAW"), 0644); err != nil {
+		t.Fatalf("Failed to create test RAW: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Files.RawExtension = config.Extensions{".RAF", ".CR3", ".NEF", ".ARW"}
+	cfg.Files.JpegExtension = config.Extensions{".JPG", ".JPEG"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	pl, err := NewImageProcessor(tmpDir, cfg, false).Plan(false)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	var deleted []string
+	for _, e := range pl.Entries {
+		if e.Action == plan.ActionDelete {
+			deleted = append(deleted, filepath.Base(e.File))
+		}
+	}
+	sort.Strings(deleted)
+	if want := "img1.JPG,img1.RAF,img2.CR3,img2.jpeg,img4.ARW"; strings.Join(deleted, ",") != want {
+		t.Errorf("Deleted %v, want %s", deleted, want)
+	}
+	if pl.Stats.Ratings[4] != 1 {
+		t.Errorf("Ratings = %v, want img3 paired with its NEF", pl.Stats.Ratings)
+	}
+
+	summary := pl.Summary()
+	for _, line := range []string{".CR3:     1 files, delete 1", ".JPEG:    1 files, delete 1", ".NEF:     1 files"} {
+		if !strings.Contains(summary, line) {
+			t.Errorf("Summary() lacks %q:\n%s", line, summary)
+		}
+	}
+}
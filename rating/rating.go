@@ -0,0 +1,71 @@
+// Package rating normalizes ratings written as percentages, e.g. by Windows
+// Explorer, to star ratings.
+package rating
+
+import (
+	"fmt"
+)
+
+const (
+	// ScaleStars is the star rating (-1 to 5) of xmp:Rating and the EXIF Rating tag
+	ScaleStars = "stars"
+
+	// ScaleMicrosoft is the percentage (0-99) of MicrosoftPhoto:Rating
+	ScaleMicrosoft = "microsoft"
+
+	// ScaleExifPercent is the percentage (0-99) of the EXIF RatingPercent tag
+	ScaleExifPercent = "exif_percent"
+)
+
+// Bucket maps the percentages from Min to Max to a star rating
+type Bucket struct {
+	Min   int `yaml:"min"`
+	Max   int `yaml:"max"`
+	Stars int `yaml:"stars"`
+}
+
+// Scale is a table of buckets converting percentages to stars
+type Scale []Bucket
+
+// Windows is the table Windows Explorer uses, it writes 1, 25, 50, 75 and 99
+// for 1 to 5 stars
+var Windows = Scale{
+	{Min: 1, Max: 12, Stars: 1},
+	{Min: 13, Max: 37, Stars: 2},
+	{Min: 38, Max: 62, Stars: 3},
+	{Min: 63, Max: 87, Stars: 4},
+	{Min: 88, Max: 99, Stars: 5},
+}
+
+// Stars converts a percentage to stars. 0 is unrated and always 0 stars
+// unless a bucket covers it.
+func (s Scale) Stars(percent int) (int, error) {
+	for _, b := range s {
+		if percent >= b.Min && percent <= b.Max {
+			return b.Stars, nil
+		}
+	}
+	if percent == 0 {
+		return 0, nil
+	}
+	return 0, fmt.Errorf("Rating %d%% outside the rating scale", percent)
+}
+
+// Validate checks that the buckets lie within 0 to 100, map to ratings
+// from -1 to 5 and do not overlap
+func (s Scale) Validate() error {
+	for i, b := range s {
+		if b.Min < 0 || b.Max > 100 || b.Min > b.Max {
+			return fmt.Errorf("Invalid rating bucket %d-%d", b.Min, b.Max)
+		}
+		if b.Stars < -1 || b.Stars > 5 {
+			return fmt.Errorf("Invalid rating %d for bucket %d-%d", b.Stars, b.Min, b.Max)
+		}
+		for _, other := range s[:i] {
+			if b.Min <= other.Max && other.Min <= b.Max {
+				return fmt.Errorf("Rating buckets %d-%d and %d-%d overlap", other.Min, other.Max, b.Min, b.Max)
+			}
+		}
+	}
+	return nil
+}
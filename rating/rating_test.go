@@ -0,0 +1,39 @@
+package rating
+
+import "testing"
+
+func TestWindowsScale(t *testing.T) {
+	// Windows Explorer writes 1, 25, 50, 75 and 99 for 1 to 5 stars
+	tests := map[int]int{0: 0, 1: 1, 12: 1, 13: 2, 25: 2, 50: 3, 62: 3, 63: 4, 75: 4, 88: 5, 99: 5}
+	for percent, want := range tests {
+		stars, err := Windows.Stars(percent)
+		if err != nil || stars != want {
+			t.Errorf("Stars(%d) = %d, %v, want %d", percent, stars, err, want)
+		}
+	}
+	if _, err := Windows.Stars(100); err == nil {
+		t.Error("Stars(100) should fail")
+	}
+	if err := Windows.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		scale Scale
+	}{
+		{name: "out of range", scale: Scale{{Min: 90, Max: 120, Stars: 5}}},
+		{name: "reversed", scale: Scale{{Min: 20, Max: 10, Stars: 1}}},
+		{name: "invalid stars", scale: Scale{{Min: 1, Max: 100, Stars: 6}}},
+		{name: "overlap", scale: Scale{{Min: 1, Max: 20, Stars: 1}, {Min: 20, Max: 40, Stars: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.scale.Validate(); err == nil {
+				t.Error("Validate() should fail")
+			}
+		})
+	}
+}
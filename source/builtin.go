@@ -0,0 +1,101 @@
+package source
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/exif"
+	"github.com/frommie/rawmanager/xmp"
+)
+
+func init() {
+	Register(config.SourceEmbedded, func(*config.Config) (RatingSource, error) { return embeddedSource{}, nil })
+	Register(config.SourceSeparate, func(*config.Config) (RatingSource, error) { return separateSource{}, nil })
+	Register(config.SourceSeparateExt, func(*config.Config) (RatingSource, error) { return separateExtSource{}, nil })
+	Register(config.SourceExif, func(*config.Config) (RatingSource, error) { return exifSource{}, nil })
+	Register(config.SourceRawSidecar, func(*config.Config) (RatingSource, error) { return rawSidecarSource{}, nil })
+}
+
+// embeddedSource reads the XMP data in the JPEG's APP1 segments
+type embeddedSource struct{}
+
+func (embeddedSource) Files(pair Pair) []string {
+	return []string{pair.Jpeg}
+}
+
+func (embeddedSource) Lookup(pair Pair) (*xmp.Metadata, error) {
+	file, err := os.Open(pair.Jpeg)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := xmp.ExtractXmpData(file)
+	if err != nil {
+		return nil, err
+	}
+	return xmp.GetMetadata(data)
+}
+
+// separateSource reads the .xmp sidecar of the JPEG (DSCF6482.xmp)
+type separateSource struct{}
+
+func (separateSource) Files(pair Pair) []string {
+	return []string{pair.Jpeg[:len(pair.Jpeg)-len(filepath.Ext(pair.Jpeg))] + ".xmp"}
+}
+
+func (s separateSource) Lookup(pair Pair) (*xmp.Metadata, error) {
+	return xmp.GetMetadataFromFile(s.Files(pair)[0])
+}
+
+// separateExtSource reads the .JPG.xmp sidecar of the JPEG (DSCF6482.JPG.xmp)
+type separateExtSource struct{}
+
+func (separateExtSource) Files(pair Pair) []string {
+	return []string{pair.Jpeg + ".xmp"}
+}
+
+func (s separateExtSource) Lookup(pair Pair) (*xmp.Metadata, error) {
+	return xmp.GetMetadataFromFile(s.Files(pair)[0])
+}
+
+// exifSource reads the EXIF Rating/RatingPercent tags of the JPEG
+type exifSource struct{}
+
+func (exifSource) Files(pair Pair) []string {
+	return []string{pair.Jpeg}
+}
+
+func (exifSource) Lookup(pair Pair) (*xmp.Metadata, error) {
+	r, err := exif.ReadRatingFromFile(pair.Jpeg)
+	if err != nil {
+		return nil, err
+	}
+	// Cameras and Windows write 0 for unrated images
+	rated := r.Stars > 0 || r.Percent > 0
+	return &xmp.Metadata{Rating: r.Stars, Rated: rated, Pick: xmp.Unflagged, Scale: r.Scale, Percent: r.Percent}, nil
+}
+
+// rawSidecarSource reads the XMP sidecar of the RAW (DSCF6482.RAF.xmp or DSCF6482.xmp)
+type rawSidecarSource struct{}
+
+func (rawSidecarSource) Files(pair Pair) []string {
+	if pair.Raw == "" {
+		return nil
+	}
+	return xmp.RawSidecarPaths(pair.Raw)
+}
+
+func (s rawSidecarSource) Lookup(pair Pair) (*xmp.Metadata, error) {
+	if pair.Raw == "" {
+		return nil, fmt.Errorf("RAW unknown")
+	}
+	for _, path := range s.Files(pair) {
+		if _, err := os.Stat(path); err == nil {
+			return xmp.GetMetadataFromFile(path)
+		}
+	}
+	return nil, fmt.Errorf("No XMP sidecar found for %s", pair.Raw)
+}
@@ -0,0 +1,125 @@
+package source
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/xmp"
+)
+
+func init() {
+	Register(config.SourceCaptureOne, func(*config.Config) (RatingSource, error) { return captureOneSource{}, nil })
+}
+
+// captureOneLabels maps the color tags of Capture One to label names
+var captureOneLabels = map[int]string{
+	1: "Red",
+	2: "Orange",
+	3: "Yellow",
+	4: "Green",
+	5: "Blue",
+	6: "Pink",
+	7: "Purple",
+}
+
+// captureOneSource reads the settings files of a Capture One session
+// (CaptureOne/Settings153/DSCF6482.RAF.cos next to the image). The RAW's
+// settings take precedence over the JPEG's, newer Settings folders over
+// older ones.
+type captureOneSource struct{}
+
+func (captureOneSource) Files(pair Pair) []string {
+	var files []string
+	for _, image := range []string{pair.Raw, pair.Jpeg} {
+		if image == "" {
+			continue
+		}
+		for _, dir := range settingsDirs(filepath.Join(filepath.Dir(image), "CaptureOne")) {
+			files = append(files, filepath.Join(dir, filepath.Base(image)+".cos"))
+		}
+	}
+	return files
+}
+
+func (s captureOneSource) Lookup(pair Pair) (*xmp.Metadata, error) {
+	for _, path := range s.Files(pair) {
+		if _, err := os.Stat(path); err == nil {
+			return readCaptureOneSettings(path)
+		}
+	}
+	return nil, fmt.Errorf("No Capture One settings found for %s", pair.Jpeg)
+}
+
+// settingsDirs returns the Settings folders of a CaptureOne folder, the
+// highest version first
+func settingsDirs(dir string) []string {
+	dirs, _ := filepath.Glob(filepath.Join(dir, "Settings*"))
+	version := func(dir string) int {
+		v, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "Settings"))
+		return v
+	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return version(dirs[i]) > version(dirs[j])
+	})
+	return dirs
+}
+
+// readCaptureOneSettings reads the Rating and ColorTag entries
+// (<E K="Rating" V="4"/>) of a .cos file. A rating of 0 counts as unrated.
+func readCaptureOneSettings(path string) (*xmp.Metadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	meta := &xmp.Metadata{Pick: xmp.Unflagged}
+	seen := map[string]bool{}
+	decoder := xml.NewDecoder(file)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing Capture One settings %s: %v", path, err)
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok || element.Name.Local != "E" {
+			continue
+		}
+
+		var key, value string
+		for _, attr := range element.Attr {
+			switch attr.Name.Local {
+			case "K":
+				key = attr.Value
+			case "V":
+				value = attr.Value
+			}
+		}
+		if seen[key] {
+			continue
+		}
+		switch key {
+		case "Rating":
+			rating, err := strconv.ParseFloat(value, 64)
+			if err != nil || rating < 0 || rating > 5 {
+				return nil, fmt.Errorf("Invalid Capture One rating in %s: %s", path, value)
+			}
+			meta.Rating, meta.Rated = int(rating), rating > 0
+		case "ColorTag":
+			tag, _ := strconv.Atoi(value)
+			meta.Label = captureOneLabels[tag]
+		}
+		seen[key] = true
+	}
+	return meta, nil
+}
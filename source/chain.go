@@ -0,0 +1,198 @@
+package source
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/xmp"
+)
+
+// Reading is the metadata of a pair as read from a single rating source
+type Reading struct {
+	Source  config.SourceName
+	ModTime time.Time // Modification time of the source's file, if any
+	Meta    *xmp.Metadata
+}
+
+// Conflict lists the rated sources of a pair that disagree on the rating
+type Conflict struct {
+	Readings []Reading
+}
+
+// Ratings returns the rating of each source
+func (c *Conflict) Ratings() map[string]int {
+	ratings := make(map[string]int, len(c.Readings))
+	for _, r := range c.Readings {
+		ratings[string(r.Source)] = r.Meta.Rating
+	}
+	return ratings
+}
+
+// String describes the disagreeing sources, e.g. "embedded 3, separate 1"
+func (c *Conflict) String() string {
+	parts := make([]string, len(c.Readings))
+	for i, r := range c.Readings {
+		parts[i] = fmt.Sprintf("%s %d", r.Source, r.Meta.Rating)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Chain looks up a pair in several rating sources in precedence order
+type Chain struct {
+	names   []config.SourceName
+	sources []RatingSource
+	policy  config.ConflictPolicy
+	xmp     config.XmpConfig
+}
+
+// NewChain creates the chain of rating sources selected by the XMP mode
+func NewChain(cfg *config.Config) (*Chain, error) {
+	names, policy := cfg.Xmp.SourceChain()
+	c := &Chain{names: names, policy: policy, xmp: cfg.Xmp}
+	for _, name := range names {
+		src, err := New(name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		c.sources = append(c.sources, src)
+	}
+	return c, nil
+}
+
+// Lookup reads the metadata of a pair. With the first policy the chain stops
+// at the first rated source, otherwise all sources are read and combined by
+// Resolve. The metadata is nil if the sources disagree and the policy is skip.
+// An error is returned only if no source yields any metadata.
+func (c *Chain) Lookup(pair Pair) (*xmp.Metadata, *Conflict, error) {
+	var readings []Reading
+	var errs []string
+	for i, src := range c.sources {
+		meta, err := src.Lookup(pair)
+		if err == nil {
+			err = Normalize(c.xmp, meta)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		readings = append(readings, Reading{Source: c.names[i], ModTime: modTime(src, pair), Meta: meta})
+		if c.policy == config.ConflictFirst && meta.Rated {
+			break
+		}
+	}
+
+	if len(readings) == 0 {
+		if len(c.sources) == 1 {
+			return nil, nil, fmt.Errorf("%s", errs[0])
+		}
+		return nil, nil, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	meta, conflict := Resolve(readings, c.policy)
+	return meta, conflict, nil
+}
+
+// Normalize converts a percent-based rating to stars with the table
+// configured for its scale
+func Normalize(cfg config.XmpConfig, meta *xmp.Metadata) error {
+	return meta.Normalize(cfg.Scale(meta.Scale))
+}
+
+// Files returns the files the sources of the chain read besides the JPEG
+func (c *Chain) Files(pair Pair) []string {
+	var files []string
+	for _, src := range c.sources {
+		fileSource, ok := src.(FileSource)
+		if !ok {
+			continue
+		}
+		for _, file := range fileSource.Files(pair) {
+			if file != pair.Jpeg {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+// Resolve combines the readings of a pair. Labels, keywords and pick flags
+// are taken from the first source that carries them. If the rated sources
+// disagree, the conflict is returned and the policy selects the rating, with
+// the skip policy no metadata is returned. The first policy uses the first
+// rated source without reporting a conflict.
+func Resolve(readings []Reading, policy config.ConflictPolicy) (*xmp.Metadata, *Conflict) {
+	meta := &xmp.Metadata{Pick: xmp.Unflagged}
+	var rated []Reading
+	for _, r := range readings {
+		if meta.Label == "" {
+			meta.Label = r.Meta.Label
+		}
+		if len(meta.Keywords) == 0 {
+			meta.Keywords = r.Meta.Keywords
+		}
+		if len(meta.HierarchicalKeywords) == 0 {
+			meta.HierarchicalKeywords = r.Meta.HierarchicalKeywords
+		}
+		if meta.Pick == xmp.Unflagged && r.Meta.Pick != "" {
+			meta.Pick = r.Meta.Pick
+		}
+		if r.Meta.Rated {
+			rated = append(rated, r)
+		}
+	}
+	if len(rated) == 0 {
+		return meta, nil
+	}
+
+	winner := rated[0]
+	var conflict *Conflict
+	if policy != config.ConflictFirst {
+		for _, r := range rated[1:] {
+			if r.Meta.Rating != winner.Meta.Rating {
+				conflict = &Conflict{Readings: rated}
+				break
+			}
+		}
+	}
+	if conflict != nil {
+		for _, r := range rated[1:] {
+			switch policy {
+			case config.ConflictHighest:
+				if r.Meta.Rating > winner.Meta.Rating {
+					winner = r
+				}
+			case config.ConflictLowest:
+				if r.Meta.Rating < winner.Meta.Rating {
+					winner = r
+				}
+			case config.ConflictNewest:
+				if r.ModTime.After(winner.ModTime) {
+					winner = r
+				}
+			default:
+				return nil, conflict
+			}
+		}
+	}
+
+	meta.Rating, meta.Rated = winner.Meta.Rating, true
+	meta.Scale, meta.Percent = winner.Meta.Scale, winner.Meta.Percent
+	return meta, conflict
+}
+
+// modTime returns the modification time of the first existing file of a
+// file source, or the zero time
+func modTime(src RatingSource, pair Pair) time.Time {
+	fileSource, ok := src.(FileSource)
+	if !ok {
+		return time.Time{}
+	}
+	for _, file := range fileSource.Files(pair) {
+		if info, err := os.Stat(file); err == nil {
+			return info.ModTime()
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,132 @@
+package source
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/xmp"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	Register(config.SourceLightroom, newLightroomSource)
+}
+
+// lightroomQuery reads the rating, pick flag and color label of every master
+// image together with the path of its file. Virtual copies are skipped.
+const lightroomQuery = `
+SELECT root.absolutePath, folder.pathFromRoot, file.baseName, file.extension,
+       COALESCE(file.sidecarExtensions, ''), image.rating, image.pick,
+       COALESCE(image.colorLabels, '')
+FROM Adobe_images image
+JOIN AgLibraryFile file ON image.rootFile = file.id_local
+JOIN AgLibraryFolder folder ON file.folder = folder.id_local
+JOIN AgLibraryRootFolder root ON folder.rootFolder = root.id_local
+WHERE image.masterImage IS NULL`
+
+// lightroomSource answers from a Lightroom Classic catalog. The catalog is
+// read once when the source is created, images are matched by the absolute
+// path of the JPEG or the RAW.
+type lightroomSource struct {
+	catalog string
+	images  map[string]*xmp.Metadata
+}
+
+func newLightroomSource(cfg *config.Config) (RatingSource, error) {
+	if cfg.Xmp.Lightroom.Catalog == "" {
+		return nil, fmt.Errorf("No Lightroom catalog configured (xmp.lightroom.catalog)")
+	}
+	catalog, err := filepath.Abs(cfg.Xmp.Lightroom.Catalog)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving Lightroom catalog: %v", err)
+	}
+	images, err := readLightroomCatalog(catalog)
+	if err != nil {
+		return nil, err
+	}
+	return &lightroomSource{catalog: catalog, images: images}, nil
+}
+
+// readLightroomCatalog maps the absolute paths of the catalog's images to
+// their metadata. JPEGs imported as sidecars of a RAW share its metadata.
+func readLightroomCatalog(catalog string) (map[string]*xmp.Metadata, error) {
+	dsn := (&url.URL{Scheme: "file", Path: filepath.ToSlash(catalog), RawQuery: "mode=ro"}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening Lightroom catalog: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(lightroomQuery)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Lightroom catalog %s: %v", catalog, err)
+	}
+	defer rows.Close()
+
+	images := make(map[string]*xmp.Metadata)
+	for rows.Next() {
+		var root, folder, base, ext, sidecars, label string
+		var rating, pick sql.NullFloat64
+		if err := rows.Scan(&root, &folder, &base, &ext, &sidecars, &rating, &pick, &label); err != nil {
+			return nil, fmt.Errorf("Error reading Lightroom catalog %s: %v", catalog, err)
+		}
+
+		// Lightroom stores 0 or NULL for unrated images
+		meta := &xmp.Metadata{Label: label, Pick: xmp.Unflagged}
+		if rating.Valid && rating.Float64 != 0 {
+			meta.Rating, meta.Rated = int(rating.Float64), true
+		}
+		switch {
+		case pick.Float64 > 0:
+			meta.Pick = xmp.Picked
+		case pick.Float64 < 0:
+			meta.Pick = xmp.Rejected
+		}
+
+		dir := root + folder
+		images[lightroomKey(dir+base+"."+ext)] = meta
+		for _, sidecar := range strings.Split(sidecars, ",") {
+			sidecar = strings.TrimSpace(sidecar)
+			if sidecar == "" || strings.EqualFold(sidecar, "xmp") {
+				continue
+			}
+			images[lightroomKey(dir+base+"."+sidecar)] = meta
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading Lightroom catalog %s: %v", catalog, err)
+	}
+	return images, nil
+}
+
+// lightroomKey normalizes a path for matching. Lightroom stores paths with
+// forward slashes and compares them case-insensitively.
+func lightroomKey(path string) string {
+	return strings.ToLower(filepath.ToSlash(filepath.Clean(path)))
+}
+
+func (l *lightroomSource) Files(Pair) []string {
+	return []string{l.catalog}
+}
+
+func (l *lightroomSource) Lookup(pair Pair) (*xmp.Metadata, error) {
+	for _, path := range []string{pair.Jpeg, pair.Raw} {
+		if path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			continue
+		}
+		if meta, exists := l.images[lightroomKey(abs)]; exists {
+			found := *meta
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not in Lightroom catalog", pair.Jpeg)
+}
@@ -0,0 +1,94 @@
+package source
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/xmp"
+)
+
+func init() {
+	Register(config.SourceRawTherapee, func(*config.Config) (RatingSource, error) { return rawTherapeeSource{}, nil })
+}
+
+// rawTherapeeLabels maps the color labels of RawTherapee and ART to label names
+var rawTherapeeLabels = map[int]string{
+	1: "Red",
+	2: "Yellow",
+	3: "Green",
+	4: "Blue",
+	5: "Purple",
+}
+
+// rawTherapeeSource reads the processing profile of RawTherapee and ART
+// next to the image (DSCF6482.RAF.pp3). The RAW's profile takes precedence
+// over the JPEG's.
+type rawTherapeeSource struct{}
+
+func (rawTherapeeSource) Files(pair Pair) []string {
+	var files []string
+	for _, image := range []string{pair.Raw, pair.Jpeg} {
+		if image != "" {
+			files = append(files, image+".pp3")
+		}
+	}
+	return files
+}
+
+func (s rawTherapeeSource) Lookup(pair Pair) (*xmp.Metadata, error) {
+	for _, path := range s.Files(pair) {
+		if _, err := os.Stat(path); err == nil {
+			return readProfile(path)
+		}
+	}
+	return nil, fmt.Errorf("No RawTherapee profile found for %s", pair.Jpeg)
+}
+
+// readProfile reads Rank, ColorLabel and InTrash from the [General] section
+// of a .pp3 file. Rank 0, written for every edited image, counts as
+// unrated; images in the trash are rejected.
+func readProfile(path string) (*xmp.Metadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	meta := &xmp.Metadata{Pick: xmp.Unflagged}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found || section != "General" {
+			continue
+		}
+		switch key {
+		case "Rank":
+			rank, err := strconv.Atoi(value)
+			if err != nil || rank < 0 || rank > 5 {
+				return nil, fmt.Errorf("Invalid RawTherapee rank in %s: %s", path, value)
+			}
+			meta.Rating, meta.Rated = rank, rank > 0
+		case "ColorLabel":
+			label, _ := strconv.Atoi(value)
+			meta.Label = rawTherapeeLabels[label]
+		case "InTrash":
+			if value == "true" {
+				meta.Pick = xmp.Rejected
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading RawTherapee profile %s: %v", path, err)
+	}
+	return meta, nil
+}
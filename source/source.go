@@ -0,0 +1,76 @@
+// Package source looks up the rating, label, keywords and pick flag of a
+// RAW+JPEG pair. Each rating source is registered by name, the configuration
+// selects an ordered chain of them.
+package source
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/xmp"
+)
+
+// Pair identifies the files of a RAW+JPEG pair. Raw is empty if the RAW is
+// unknown, e.g. when restoring originals.
+type Pair struct {
+	Jpeg string
+	Raw  string
+}
+
+// RatingSource looks up the metadata of a pair. An error means the source
+// holds nothing usable for the pair, the next source of the chain is tried.
+type RatingSource interface {
+	Lookup(pair Pair) (*xmp.Metadata, error)
+}
+
+// FileSource is a rating source reading files of its own, e.g. sidecars.
+// The first existing file supplies the modification time for the
+// newest-mtime policy, and changes to the files invalidate the incremental
+// state of the pair.
+type FileSource interface {
+	RatingSource
+	Files(pair Pair) []string
+}
+
+// Factory creates a rating source for a configuration
+type Factory func(cfg *config.Config) (RatingSource, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[config.SourceName]Factory{}
+)
+
+// Register makes a rating source available under name, e.g. from the init
+// function of an in-house package. Registering a name twice replaces the
+// factory.
+func Register(name config.SourceName, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = factory
+	config.RegisterSource(name)
+}
+
+// New creates the rating source registered under name
+func New(name config.SourceName, cfg *config.Config) (RatingSource, error) {
+	registryMu.RLock()
+	factory, exists := registry[name]
+	registryMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("Unknown rating source: %s", name)
+	}
+	return factory(cfg)
+}
+
+// Names returns the names of all registered rating sources
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,345 @@
+package source
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/testutils"
+	"github.com/frommie/rawmanager/xmp"
+)
+
+func TestResolve(t *testing.T) {
+	now := time.Now()
+	readings := []Reading{
+		{Source: config.SourceEmbedded, ModTime: now.Add(-time.Hour), Meta: &xmp.Metadata{Rating: 3, Rated: true, Label: "Red"}},
+		{Source: config.SourceSeparate, ModTime: now, Meta: &xmp.Metadata{Rating: 1, Rated: true, Keywords: []string{"print"}}},
+		{Source: config.SourceExif, ModTime: now.Add(-time.Hour), Meta: &xmp.Metadata{Rating: 5, Rated: true}},
+	}
+
+	tests := []struct {
+		policy config.ConflictPolicy
+		want   int
+	}{
+		{policy: config.ConflictHighest, want: 5},
+		{policy: config.ConflictLowest, want: 1},
+		{policy: config.ConflictNewest, want: 1},
+		{policy: config.ConflictSkip, want: -2},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			meta, conflict := Resolve(readings, tt.policy)
+			if conflict == nil || len(conflict.Readings) != 3 {
+				t.Fatalf("Resolve() conflict = %v, want all three sources", conflict)
+			}
+			if tt.policy == config.ConflictSkip {
+				if meta != nil {
+					t.Errorf("Resolve() = %+v, want nil", meta)
+				}
+				return
+			}
+			if meta.Rating != tt.want {
+				t.Errorf("Rating = %d, want %d", meta.Rating, tt.want)
+			}
+			// Label and keywords come from the first source carrying them
+			if meta.Label != "Red" || !meta.HasKeyword("print") {
+				t.Errorf("Metadata = %+v, want label Red and keyword print", meta)
+			}
+		})
+	}
+
+	// Agreeing sources are no conflict
+	meta, conflict := Resolve(readings[:1], config.ConflictSkip)
+	if conflict != nil || meta.Rating != 3 {
+		t.Errorf("Resolve() = %+v, %v, want rating 3 without conflict", meta, conflict)
+	}
+
+	// The first policy never reports a conflict
+	meta, conflict = Resolve(readings, config.ConflictFirst)
+	if conflict != nil || meta.Rating != 3 {
+		t.Errorf("Resolve() = %+v, %v, want rating 3 without conflict", meta, conflict)
+	}
+}
+
+func TestChainAuto(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img.JPG")
+	rawPath := filepath.Join(tmpDir, "img.RAF")
+	if err := testutils.CreateTestJPEGWithEmbeddedXMP(t, jpgPath, 2); err != nil {
+		t.Fatalf("Failed to create test JPEG: %v", err)
+	}
+	if err := testutils.CreateTestXMP(t, rawPath+".xmp", 4); err != nil {
+		t.Fatalf("Failed to create sidecar: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeAuto
+	cfg.Xmp.Conflict = config.ConflictHighest
+	chain, err := NewChain(cfg)
+	if err != nil {
+		t.Fatalf("NewChain() error = %v", err)
+	}
+	meta, conflict, err := chain.Lookup(Pair{Jpeg: jpgPath, Raw: rawPath})
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if conflict == nil || conflict.String() != "embedded 2, raw_sidecar 4" || meta.Rating != 4 {
+		t.Errorf("Lookup() = %+v, %v, want rating 4 and a conflict", meta, conflict)
+	}
+
+	// Without the RAW its sidecar is not consulted
+	meta, conflict, err = chain.Lookup(Pair{Jpeg: jpgPath})
+	if err != nil || conflict != nil || meta.Rating != 2 {
+		t.Errorf("Lookup() = %+v, %v, %v, want rating 2", meta, conflict, err)
+	}
+}
+
+func TestChainAutoUnratedExif(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img.JPG")
+	if err := testutils.CreateTestJPEGWithExifRating(t, jpgPath, map[string]uint16{"Rating": 0}); err != nil {
+		t.Fatalf("Failed to create test JPEG: %v", err)
+	}
+	if err := testutils.CreateTestXMP(t, jpgPath+".xmp", 3); err != nil {
+		t.Fatalf("Failed to create sidecar: %v", err)
+	}
+
+	// EXIF rating 0 means unrated and does not conflict with the XMP rating
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeAuto
+	chain, err := NewChain(cfg)
+	if err != nil {
+		t.Fatalf("NewChain() error = %v", err)
+	}
+	meta, conflict, err := chain.Lookup(Pair{Jpeg: jpgPath})
+	if err != nil || conflict != nil || meta == nil || meta.Rating != 3 {
+		t.Errorf("Lookup() = %+v, %v, %v, want rating 3 without conflict", meta, conflict, err)
+	}
+}
+
+// reviewSource is an in-house source answering from a fixed table
+type reviewSource map[string]int
+
+func (r reviewSource) Lookup(pair Pair) (*xmp.Metadata, error) {
+	rating, exists := r[filepath.Base(pair.Jpeg)]
+	if !exists {
+		return nil, fmt.Errorf("%s not reviewed", pair.Jpeg)
+	}
+	return &xmp.Metadata{Rating: rating, Rated: true, Pick: xmp.Unflagged}, nil
+}
+
+func TestRegister(t *testing.T) {
+	Register("review", func(*config.Config) (RatingSource, error) {
+		return reviewSource{"img1.JPG": 5}, nil
+	})
+
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "img2.JPG")
+	if err := testutils.CreateTestJPEGWithEmbeddedXMP(t, jpgPath, 1); err != nil {
+		t.Fatalf("Failed to create test JPEG: %v", err)
+	}
+
+	// Registered names pass validation and fall back along the chain
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeAuto
+	cfg.Xmp.Sources = []config.SourceName{"review", config.SourceEmbedded}
+	cfg.Xmp.Conflict = config.ConflictFirst
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	chain, err := NewChain(cfg)
+	if err != nil {
+		t.Fatalf("NewChain() error = %v", err)
+	}
+
+	meta, _, err := chain.Lookup(Pair{Jpeg: filepath.Join(tmpDir, "img1.JPG")})
+	if err != nil || meta.Rating != 5 {
+		t.Errorf("Lookup(img1) = %+v, %v, want rating 5 from the review source", meta, err)
+	}
+	meta, _, err = chain.Lookup(Pair{Jpeg: jpgPath})
+	if err != nil || meta.Rating != 1 {
+		t.Errorf("Lookup(img2) = %+v, %v, want embedded rating 1", meta, err)
+	}
+
+	if _, err := New("unknown", cfg); err == nil {
+		t.Error("New() should fail for unregistered sources")
+	}
+}
+
+// createCatalog builds a Lightroom catalog from the fixture in testdata
+func createCatalog(t *testing.T) string {
+	t.Helper()
+	fixture, err := os.ReadFile(filepath.Join("testdata", "lightroom.sql"))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	catalog := filepath.Join(t.TempDir(), "Catalog.lrcat")
+	db, err := sql.Open("sqlite", catalog)
+	if err != nil {
+		t.Fatalf("Failed to create catalog: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(string(fixture)); err != nil {
+		t.Fatalf("Failed to create catalog: %v", err)
+	}
+	return catalog
+}
+
+func TestLightroomSource(t *testing.T) {
+	catalog := createCatalog(t)
+	before, err := os.ReadFile(catalog)
+	if err != nil {
+		t.Fatalf("Failed to read catalog: %v", err)
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Lightroom.Catalog = catalog
+	src, err := New(config.SourceLightroom, cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		pair  Pair
+		want  xmp.Metadata
+		fails bool
+	}{
+		{
+			name: "RAW with sidecar JPEG",
+			pair: Pair{Jpeg: "/photos/2024/05/DSCF0001.JPG", Raw: "/photos/2024/05/DSCF0001.RAF"},
+			want: xmp.Metadata{Rating: 4, Rated: true, Label: "Red", Pick: xmp.Unflagged},
+		},
+		{
+			name: "unrated reject matched by the RAW",
+			pair: Pair{Jpeg: "/photos/2024/05/other.jpg", Raw: "/photos/2024/05/dscf0002.raf"},
+			want: xmp.Metadata{Pick: xmp.Rejected},
+		},
+		{
+			name: "separate JPEG",
+			pair: Pair{Jpeg: "/photos/2024/05/DSCF0003.JPG"},
+			want: xmp.Metadata{Rating: 1, Rated: true, Label: "Green", Pick: xmp.Picked},
+		},
+		{
+			name: "rating 0 is unrated",
+			pair: Pair{Jpeg: "/photos/2024/05/DSCF0005.JPG"},
+			want: xmp.Metadata{Pick: xmp.Unflagged},
+		},
+		{
+			name:  "not in catalog",
+			pair:  Pair{Jpeg: "/photos/2024/05/DSCF0004.JPG", Raw: "/photos/2024/05/DSCF0004.RAF"},
+			fails: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := src.Lookup(tt.pair)
+			if tt.fails {
+				if err == nil {
+					t.Errorf("Lookup() = %+v, want error", meta)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Lookup() error = %v", err)
+			}
+			if meta.Rating != tt.want.Rating || meta.Rated != tt.want.Rated || meta.Label != tt.want.Label || meta.Pick != tt.want.Pick {
+				t.Errorf("Lookup() = %+v, want %+v", *meta, tt.want)
+			}
+		})
+	}
+
+	// The catalog is only read
+	after, err := os.ReadFile(catalog)
+	if err != nil {
+		t.Fatalf("Failed to read catalog: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("Catalog was modified")
+	}
+
+	cfg.Xmp.Lightroom.Catalog = ""
+	if _, err := New(config.SourceLightroom, cfg); err == nil {
+		t.Error("New() should fail without a catalog")
+	}
+}
+
+func TestCaptureOneSource(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "DSCF0001.JPG")
+	rawPath := filepath.Join(tmpDir, "DSCF0001.RAF")
+	settings := map[string]string{
+		"Settings131/DSCF0001.RAF.cos": `<E K="Rating" V="2"/>`,
+		"Settings153/DSCF0001.RAF.cos": `<E K="ColorTag" V="4"/><E K="Rating" V="4"/>`,
+		"Settings153/DSCF0001.JPG.cos": `<E K="Rating" V="1"/>`,
+	}
+	for name, entries := range settings {
+		path := filepath.Join(tmpDir, "CaptureOne", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create settings folder: %v", err)
+		}
+		content := `<?xml version="1.0" encoding="UTF-8" standalone="no"?><SL Engine="1300"><DL>` + entries + `</DL></SL>`
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write settings: %v", err)
+		}
+	}
+
+	cfg := config.NewDefaultConfig()
+	cfg.Xmp.Mode = config.XmpModeCaptureOne
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	chain, err := NewChain(cfg)
+	if err != nil {
+		t.Fatalf("NewChain() error = %v", err)
+	}
+
+	// The RAW's settings of the newest Capture One version win
+	meta, _, err := chain.Lookup(Pair{Jpeg: jpgPath, Raw: rawPath})
+	if err != nil || meta.Rating != 4 || meta.Label != "Green" {
+		t.Errorf("Lookup() = %+v, %v, want rating 4 and label Green", meta, err)
+	}
+	meta, _, err = chain.Lookup(Pair{Jpeg: jpgPath})
+	if err != nil || meta.Rating != 1 {
+		t.Errorf("Lookup() = %+v, %v, want rating 1 of the JPEG", meta, err)
+	}
+	if _, _, err := chain.Lookup(Pair{Jpeg: filepath.Join(tmpDir, "DSCF0002.JPG")}); err == nil {
+		t.Error("Lookup() should fail without settings")
+	}
+}
+
+func TestRawTherapeeSource(t *testing.T) {
+	tmpDir := t.TempDir()
+	rawPath := filepath.Join(tmpDir, "DSCF0001.RAF")
+	profiles := map[string]string{
+		"DSCF0001.RAF.pp3": "[Version]\nAppVersion=5.10\n\n[General]\nRank=3\nColorLabel=4\nInTrash=false\n",
+		"DSCF0002.RAF.pp3": "[General]\nRank=0\nColorLabel=0\nInTrash=true\n",
+		"DSCF0003.RAF.pp3": "[General]\nRank=7\n",
+	}
+	for name, content := range profiles {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write profile: %v", err)
+		}
+	}
+
+	src, err := New(config.SourceRawTherapee, config.NewDefaultConfig())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	meta, err := src.Lookup(Pair{Jpeg: filepath.Join(tmpDir, "DSCF0001.JPG"), Raw: rawPath})
+	if err != nil || meta.Rating != 3 || !meta.Rated || meta.Label != "Blue" || meta.Pick != xmp.Unflagged {
+		t.Errorf("Lookup() = %+v, %v, want rating 3 and label Blue", meta, err)
+	}
+	meta, err = src.Lookup(Pair{Jpeg: filepath.Join(tmpDir, "DSCF0002.JPG"), Raw: filepath.Join(tmpDir, "DSCF0002.RAF")})
+	if err != nil || meta.Rated || meta.Pick != xmp.Rejected {
+		t.Errorf("Lookup() = %+v, %v, want an unrated reject", meta, err)
+	}
+	if _, err := src.Lookup(Pair{Jpeg: filepath.Join(tmpDir, "DSCF0003.JPG"), Raw: filepath.Join(tmpDir, "DSCF0003.RAF")}); err == nil {
+		t.Error("Lookup() should fail for an invalid rank")
+	}
+}
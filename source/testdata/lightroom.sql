@@ -0,0 +1,62 @@
+-- Subset of a Lightroom Classic catalog (.lrcat) with the tables and
+-- columns read by the lightroom rating source
+CREATE TABLE AgLibraryRootFolder (
+    id_local INTEGER PRIMARY KEY,
+    id_global UNIQUE NOT NULL,
+    absolutePath UNIQUE NOT NULL DEFAULT '',
+    name NOT NULL DEFAULT '',
+    relativePathFromCatalog
+);
+CREATE TABLE AgLibraryFolder (
+    id_local INTEGER PRIMARY KEY,
+    id_global UNIQUE NOT NULL,
+    parentId INTEGER,
+    pathFromRoot NOT NULL DEFAULT '',
+    rootFolder INTEGER NOT NULL DEFAULT 0,
+    visibility INTEGER
+);
+CREATE TABLE AgLibraryFile (
+    id_local INTEGER PRIMARY KEY,
+    id_global UNIQUE NOT NULL,
+    baseName NOT NULL DEFAULT '',
+    extension NOT NULL DEFAULT '',
+    folder INTEGER NOT NULL DEFAULT 0,
+    idx_filename NOT NULL DEFAULT '',
+    lc_idx_filename NOT NULL DEFAULT '',
+    originalFilename NOT NULL DEFAULT '',
+    sidecarExtensions
+);
+CREATE TABLE Adobe_images (
+    id_local INTEGER PRIMARY KEY,
+    id_global UNIQUE NOT NULL,
+    captureTime,
+    colorLabels NOT NULL DEFAULT '',
+    fileFormat NOT NULL DEFAULT 'unset',
+    masterImage INTEGER,
+    pick NOT NULL DEFAULT 0,
+    rating,
+    rootFile INTEGER NOT NULL DEFAULT 0,
+    touchTime NOT NULL DEFAULT 0
+);
+
+INSERT INTO AgLibraryRootFolder VALUES (1, 'R1', '/photos/', 'photos', NULL);
+INSERT INTO AgLibraryFolder VALUES (2, 'F2', NULL, '2024/05/', 1, NULL);
+
+-- RAW with its JPEG imported as sidecar
+INSERT INTO AgLibraryFile VALUES (3, 'L3', 'DSCF0001', 'RAF', 2, 'DSCF0001.RAF', 'dscf0001.raf', 'DSCF0001.RAF', 'JPG');
+INSERT INTO Adobe_images VALUES (4, 'I4', '2024-05-04T10:00:00', 'Red', 'RAW', NULL, 0, 4.0, 3, 0);
+
+-- Virtual copy of the first image, which must be ignored
+INSERT INTO Adobe_images VALUES (5, 'I5', '2024-05-04T10:00:00', '', 'RAW', 4, 0, 5.0, 3, 0);
+
+-- Unrated reject with JPEG and XMP sidecars
+INSERT INTO AgLibraryFile VALUES (6, 'L6', 'DSCF0002', 'RAF', 2, 'DSCF0002.RAF', 'dscf0002.raf', 'DSCF0002.RAF', 'JPG,xmp');
+INSERT INTO Adobe_images VALUES (7, 'I7', '2024-05-04T10:01:00', '', 'RAW', NULL, -1, NULL, 6, 0);
+
+-- JPEG imported as separate photo
+INSERT INTO AgLibraryFile VALUES (8, 'L8', 'DSCF0003', 'JPG', 2, 'DSCF0003.JPG', 'dscf0003.jpg', 'DSCF0003.JPG', NULL);
+INSERT INTO Adobe_images VALUES (9, 'I9', '2024-05-04T10:02:00', 'Green', 'JPG', NULL, 1, 1.0, 8, 0);
+
+-- Unrated JPEG, Lightroom stores rating 0
+INSERT INTO AgLibraryFile VALUES (10, 'L10', 'DSCF0005', 'JPG', 2, 'DSCF0005.JPG', 'dscf0005.jpg', 'DSCF0005.JPG', NULL);
+INSERT INTO Adobe_images VALUES (11, 'I11', '2024-05-04T10:03:00', '', 'JPG', NULL, 0, 0.0, 10, 0);
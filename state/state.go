@@ -0,0 +1,188 @@
+// Package state persists information about the library between runs in a
+// single file at the library root.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/frommie/rawmanager/fsutil"
+)
+
+// DefaultFile is the state file relative to the library root
+const DefaultFile = ".rawmanager/state.json"
+
+// FileState identifies a version of a file
+type FileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// PairState is the result of the last evaluation of a RAW+JPEG pair
+type PairState struct {
+	Jpeg    FileState  `json:"jpeg"`
+	Raw     FileState  `json:"raw"`
+	Sidecar *FileState `json:"sidecar,omitempty"`
+	Rating  int        `json:"rating"`
+	Action  string     `json:"action"`
+
+	// Sources holds the files of the rating sources besides the JPEG by
+	// their relative path
+	Sources map[string]FileState `json:"sources,omitempty"`
+}
+
+type State struct {
+	// Orphans maps RAW files without JPEG to the time they were first seen
+	Orphans map[string]time.Time `json:"orphans"`
+
+	// Pairs maps JPEG files to the last evaluation of their pair
+	Pairs map[string]PairState `json:"pairs"`
+
+	// ConfigHash identifies the configuration the pairs were evaluated with
+	ConfigHash string `json:"configHash"`
+
+	path        string
+	seenOrphans map[string]bool
+	seenPairs   map[string]bool
+}
+
+// Load reads the state of the library at rootDir. A missing file yields an empty state.
+func Load(rootDir string) (*State, error) {
+	s := &State{
+		Orphans:     map[string]time.Time{},
+		Pairs:       map[string]PairState{},
+		path:        filepath.Join(rootDir, DefaultFile),
+		seenOrphans: map[string]bool{},
+		seenPairs:   map[string]bool{},
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("Error reading state file: %v", err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("Error parsing state file %s: %v", s.path, err)
+	}
+	if s.Orphans == nil {
+		s.Orphans = map[string]time.Time{}
+	}
+	if s.Pairs == nil {
+		s.Pairs = map[string]PairState{}
+	}
+	return s, nil
+}
+
+// Stat returns the state of a file, or nil if it does not exist
+func Stat(path string) *FileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	return &FileState{Size: info.Size(), ModTime: info.ModTime()}
+}
+
+// SetConfigHash forgets all pair evaluations made with another configuration
+func (s *State) SetConfigHash(hash string) {
+	if s.ConfigHash != hash {
+		s.Pairs = map[string]PairState{}
+		s.ConfigHash = hash
+	}
+}
+
+// UnchangedPair returns the last evaluation of the pair key if none of its
+// files changed since
+func (s *State) UnchangedPair(key string, current PairState) (PairState, bool) {
+	s.seenPairs[key] = true
+	cached, exists := s.Pairs[key]
+	if !exists || !sameFile(&cached.Jpeg, &current.Jpeg) || !sameFile(&cached.Raw, &current.Raw) ||
+		!sameFile(cached.Sidecar, current.Sidecar) || !sameSources(cached.Sources, current.Sources) || cached.Action == "" {
+		return PairState{}, false
+	}
+	return cached, true
+}
+
+// SetPair stores the evaluation of the pair key
+func (s *State) SetPair(key string, pair PairState) {
+	s.seenPairs[key] = true
+	s.Pairs[key] = pair
+}
+
+// ForgetPair removes the evaluation of the pair key
+func (s *State) ForgetPair(key string) {
+	delete(s.Pairs, key)
+}
+
+// PrunePairs forgets all pairs that were not seen since loading
+func (s *State) PrunePairs() {
+	for key := range s.Pairs {
+		if !s.seenPairs[key] {
+			delete(s.Pairs, key)
+		}
+	}
+}
+
+// sameFile compares two file states, nil meaning the file does not exist
+func sameFile(a, b *FileState) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Size == b.Size && a.ModTime.Equal(b.ModTime)
+}
+
+// sameSources reports whether two sets of source files are identical
+func sameSources(a, b map[string]FileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, fileState := range a {
+		other, exists := b[path]
+		if !exists || !sameFile(&fileState, &other) {
+			return false
+		}
+	}
+	return true
+}
+
+// SeenOrphan records that the RAW file key is orphaned and returns when
+// it was first seen orphaned
+func (s *State) SeenOrphan(key string, now time.Time) time.Time {
+	s.seenOrphans[key] = true
+	firstSeen, exists := s.Orphans[key]
+	if !exists {
+		s.Orphans[key] = now
+		return now
+	}
+	return firstSeen
+}
+
+// PruneOrphans forgets all orphans that were not seen since loading,
+// e.g. because their JPEG reappeared or the RAW is gone
+func (s *State) PruneOrphans() {
+	for key := range s.Orphans {
+		if !s.seenOrphans[key] {
+			delete(s.Orphans, key)
+		}
+	}
+}
+
+// Save writes the state atomically
+func (s *State) Save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("Error serializing state: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("Error creating state directory: %v", err)
+	}
+
+	if err := fsutil.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("Error writing state file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrphans(t *testing.T) {
+	rootDir := t.TempDir()
+	firstRun := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	s, err := Load(rootDir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	s.SeenOrphan("raw/a.RAF", firstRun)
+	s.SeenOrphan("raw/b.RAF", firstRun)
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// Second run: a.RAF is still orphaned, b.RAF got its JPEG back
+	s, err = Load(rootDir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if got := s.SeenOrphan("raw/a.RAF", firstRun.Add(48*time.Hour)); !got.Equal(firstRun) {
+		t.Errorf("SeenOrphan() = %v, want first seen %v", got, firstRun)
+	}
+	s.PruneOrphans()
+	if _, exists := s.Orphans["raw/b.RAF"]; exists {
+		t.Error("b.RAF should have been pruned")
+	}
+	if _, exists := s.Orphans["raw/a.RAF"]; !exists {
+		t.Error("a.RAF should have been kept")
+	}
+}
+
+func TestUnchangedPair(t *testing.T) {
+	s, err := Load(t.TempDir())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	pair := PairState{
+		Jpeg:   FileState{Size: 100, ModTime: modTime},
+		Raw:    FileState{Size: 200, ModTime: modTime},
+		Rating: 3,
+		Action: "keep",
+	}
+	s.SetConfigHash("a")
+	s.SetPair("img1.JPG", pair)
+
+	current := pair
+	current.Rating, current.Action = 0, ""
+	if cached, ok := s.UnchangedPair("img1.JPG", current); !ok || cached.Rating != 3 {
+		t.Errorf("UnchangedPair() = %+v, %v, want cached rating 3", cached, ok)
+	}
+
+	changed := current
+	changed.Jpeg.Size = 101
+	if _, ok := s.UnchangedPair("img1.JPG", changed); ok {
+		t.Error("Changed JPEG must not be reported as unchanged")
+	}
+
+	withSidecar := current
+	withSidecar.Sidecar = &FileState{Size: 10, ModTime: modTime}
+	if _, ok := s.UnchangedPair("img1.JPG", withSidecar); ok {
+		t.Error("New sidecar must not be reported as unchanged")
+	}
+
+	// Another configuration invalidates all evaluations
+	s.SetConfigHash("b")
+	if _, ok := s.UnchangedPair("img1.JPG", current); ok {
+		t.Error("Evaluation of another configuration must not be used")
+	}
+}
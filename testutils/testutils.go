@@ -2,10 +2,16 @@
 package testutils
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/disintegration/imaging"
+	"github.com/dsoprea/go-jpeg-image-structure/v2"
 	"image/color"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -83,6 +89,61 @@ func CreateTestJPEGWithEmbeddedXMP(t *testing.T, path string, rating int) error
 	return nil
 }
 
+// CreateTestJPEGWithExtendedXMP creates a JPEG file whose standard XMP packet
+// carries the rating and announces the extended packet, which is split into
+// APP1 chunks of chunkSize bytes. The chunks are written in reverse order.
+func CreateTestJPEGWithExtendedXMP(t *testing.T, path string, rating int, extended string, chunkSize int) error {
+	t.Helper()
+
+	img := imaging.New(100, 100, color.White)
+	if err := imaging.Save(img, path, imaging.JPEGQuality(90)); err != nil {
+		return fmt.Errorf("Error creating JPEG: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading JPEG: %v", err)
+	}
+
+	sum := md5.Sum([]byte(extended))
+	guid := strings.ToUpper(hex.EncodeToString(sum[:]))
+	standard := fmt.Sprintf(`<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+    <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+        <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+            xmlns:xmpNote="http://ns.adobe.com/xmp/note/" xmpNote:HasExtendedXMP="%s">
+            <xmp:Rating>%d</xmp:Rating>
+        </rdf:Description>
+    </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`, guid, rating)
+
+	// appendSegment appends an APP1 segment
+	appendSegment := func(out []byte, payload []byte) []byte {
+		length := len(payload) + 2
+		out = append(out, 0xFF, 0xE1, byte(length>>8), byte(length&0xFF))
+		return append(out, payload...)
+	}
+
+	newData := []byte{0xFF, 0xD8}
+	newData = appendSegment(newData, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), standard...))
+	for offset := (len(extended) - 1) / chunkSize * chunkSize; offset >= 0; offset -= chunkSize {
+		end := offset + chunkSize
+		if end > len(extended) {
+			end = len(extended)
+		}
+		payload := append([]byte("http://ns.adobe.com/xmp/extension/\x00"), guid...)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(extended)))
+		payload = binary.BigEndian.AppendUint32(payload, uint32(offset))
+		newData = appendSegment(newData, append(payload, extended[offset:end]...))
+	}
+	newData = append(newData, data[2:]...)
+
+	if err := os.WriteFile(path, newData, 0644); err != nil {
+		return fmt.Errorf("Error writing JPEG: %v", err)
+	}
+	return nil
+}
+
 // CreateTestDirectory creates a test directory structure with JPEG and RAW files.
 // It is used for integration testing of the file processor.
 func CreateTestDirectory(t *testing.T, baseDir string, files map[string]int) error {
@@ -106,3 +167,100 @@ func CreateTestDirectory(t *testing.T, baseDir string, files map[string]int) err
 
 	return nil
 }
+
+// CreateTestJPEGWithExifRating creates a JPEG file whose EXIF data carries
+// the given SHORT tags, e.g. "Rating" or "RatingPercent".
+func CreateTestJPEGWithExifRating(t *testing.T, path string, tags map[string]uint16) error {
+	t.Helper()
+
+	if err := CreateEmptyJPEG(t, path); err != nil {
+		return fmt.Errorf("Error creating JPEG: %v", err)
+	}
+
+	intfc, err := jpegstructure.NewJpegMediaParser().ParseFile(path)
+	if err != nil {
+		return fmt.Errorf("Error parsing JPEG: %v", err)
+	}
+	sl := intfc.(*jpegstructure.SegmentList)
+
+	ib, err := sl.ConstructExifBuilder()
+	if err != nil {
+		return fmt.Errorf("Error creating EXIF data: %v", err)
+	}
+	for name, value := range tags {
+		if err := ib.AddStandardWithName(name, []uint16{value}); err != nil {
+			return fmt.Errorf("Error adding EXIF tag %s: %v", name, err)
+		}
+	}
+	if err := sl.SetExif(ib); err != nil {
+		return fmt.Errorf("Error setting EXIF data: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := sl.Write(&buf); err != nil {
+		return fmt.Errorf("Error writing JPEG: %v", err)
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// CreateTestHEIFWithXMP creates a minimal HEIF file with a placeholder image
+// item and an XMP item carrying the rating. The XMP item is stored in the
+// mdat box, or in the idat box of the meta box if idat is set.
+func CreateTestHEIFWithXMP(t *testing.T, path string, rating int, idat bool) error {
+	t.Helper()
+
+	xmpData := []byte(fmt.Sprintf(`<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+    <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+        <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/">
+            <xmp:Rating>%d</xmp:Rating>
+        </rdf:Description>
+    </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`, rating))
+	image := bytes.Repeat([]byte{0xAB}, 64)
+
+	box := func(typ string, payload ...[]byte) []byte {
+		data := bytes.Join(payload, nil)
+		out := binary.BigEndian.AppendUint32(nil, uint32(len(data)+8))
+		return append(append(out, typ...), data...)
+	}
+	fullBox := func(typ string, version byte, payload ...[]byte) []byte {
+		return box(typ, append([][]byte{{version, 0, 0, 0}}, payload...)...)
+	}
+	u16 := func(v int) []byte { return binary.BigEndian.AppendUint16(nil, uint16(v)) }
+	u32 := func(v int) []byte { return binary.BigEndian.AppendUint32(nil, uint32(v)) }
+
+	ftyp := box("ftyp", []byte("heic"), u32(0), []byte("mif1heic"))
+	meta := func(mdatStart int) []byte {
+		xmpMethod, xmpOffset := 0, mdatStart+len(image)
+		var extra []byte
+		if idat {
+			xmpMethod, xmpOffset = 1, 0
+			extra = box("idat", xmpData)
+		}
+		iloc := fullBox("iloc", 1,
+			[]byte{0x44, 0x00}, u16(2),
+			u16(1), u16(0), u16(0), u16(1), u32(mdatStart), u32(len(image)),
+			u16(2), u16(xmpMethod), u16(0), u16(1), u32(xmpOffset), u32(len(xmpData)))
+		return fullBox("meta", 0,
+			fullBox("hdlr", 0, u32(0), []byte("pict"), make([]byte, 13)),
+			fullBox("pitm", 0, u16(1)),
+			fullBox("iinf", 0, u16(2),
+				fullBox("infe", 2, u16(1), u16(0), []byte("hvc1\x00")),
+				fullBox("infe", 2, u16(2), u16(0), []byte("mime\x00application/rdf+xml\x00"))),
+			iloc, extra)
+	}
+
+	// The size of meta does not depend on the offsets it carries
+	mdatStart := len(ftyp) + len(meta(0)) + 8
+	mdat := image
+	if !idat {
+		mdat = append(append([]byte{}, image...), xmpData...)
+	}
+	data := bytes.Join([][]byte{ftyp, meta(mdatStart), box("mdat", mdat)}, nil)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Error writing HEIF: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+// Package trash provides the deletion backends used by the processor:
+// hard delete, a per-library quarantine and the freedesktop.org trash.
+package trash
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/frommie/rawmanager/config"
+	"github.com/frommie/rawmanager/fsutil"
+)
+
+// RunIDFormat is the layout of run IDs, which also name the quarantine batches
+const RunIDFormat = "20060102-150405"
+
+// Remover deletes files in two steps, so the caller can journal where the
+// bytes go before the file is touched
+type Remover interface {
+	// Reserve returns where the bytes of path will go.
+	// An empty location means the bytes are gone for good.
+	Reserve(path string) (string, error)
+
+	// Remove deletes the file, moving it to the reserved location unless
+	// that is empty
+	Remove(path string, location string) error
+}
+
+// New creates the remover configured in cfg for the library at rootDir
+func New(cfg *config.Config, rootDir string, runID string) (Remover, error) {
+	switch cfg.Delete.Mode {
+	case config.DeleteModeRemove, "":
+		return hardRemover{}, nil
+
+	case config.DeleteModeQuarantine:
+		absRoot, err := filepath.Abs(rootDir)
+		if err != nil {
+			return nil, fmt.Errorf("Error resolving library root: %v", err)
+		}
+		return &quarantine{
+			rootDir: absRoot,
+			dir:     filepath.Join(QuarantineDir(cfg, absRoot), runID),
+		}, nil
+
+	case config.DeleteModeTrash:
+		dir, err := homeTrashDir()
+		if err != nil {
+			return nil, err
+		}
+		return &freedesktopTrash{dir: dir}, nil
+
+	default:
+		return nil, fmt.Errorf("Invalid delete mode: %s", cfg.Delete.Mode)
+	}
+}
+
+// QuarantineDir returns the quarantine folder of the library at rootDir
+func QuarantineDir(cfg *config.Config, rootDir string) string {
+	dir := cfg.Delete.QuarantineDir
+	if dir == "" {
+		dir = config.DefaultQuarantineDir
+	}
+	return config.ResolvePath(rootDir, dir)
+}
+
+// hardRemover deletes files permanently
+type hardRemover struct{}
+
+func (hardRemover) Reserve(path string) (string, error) {
+	return "", nil
+}
+
+func (hardRemover) Remove(path string, location string) error {
+	return os.Remove(path)
+}
+
+// quarantine moves files into a batch folder that mirrors the library paths
+type quarantine struct {
+	rootDir string
+	dir     string
+}
+
+func (q *quarantine) Reserve(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(q.rootDir, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the library %s", path, q.rootDir)
+	}
+	return filepath.Join(q.dir, rel), nil
+}
+
+func (q *quarantine) Remove(path string, location string) error {
+	return MoveFile(path, location)
+}
+
+// freedesktopTrash implements the freedesktop.org trash specification
+type freedesktopTrash struct {
+	dir string
+}
+
+// homeTrashDir returns $XDG_DATA_HOME/Trash, falling back to ~/.local/share/Trash
+func homeTrashDir() (string, error) {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return filepath.Join(dataHome, "Trash"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Error determining home directory: %v", err)
+	}
+	return filepath.Join(home, ".local", "share", "Trash"), nil
+}
+
+// Reserve writes the trash info file, which reserves a unique name in the trash
+func (t *freedesktopTrash) Reserve(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(absPath); err != nil {
+		return "", err
+	}
+
+	filesDir := filepath.Join(t.dir, "files")
+	infoDir := filepath.Join(t.dir, "info")
+	for _, dir := range []string{filesDir, infoDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", fmt.Errorf("Error creating trash directory: %v", err)
+		}
+	}
+
+	info := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: absPath}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+
+	// Reserve a unique name by creating the info file exclusively
+	base := filepath.Base(absPath)
+	name := base
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(filepath.Join(filesDir, name)); os.IsNotExist(err) {
+			err := writeExclusive(filepath.Join(infoDir, name+".trashinfo"), info)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, os.ErrExist) {
+				return "", fmt.Errorf("Error writing trash info: %v", err)
+			}
+		}
+		name = fmt.Sprintf("%s.%d", base, i)
+	}
+
+	return filepath.Join(filesDir, name), nil
+}
+
+func (t *freedesktopTrash) Remove(path string, location string) error {
+	if err := MoveFile(path, location); err != nil {
+		os.Remove(filepath.Join(t.dir, "info", filepath.Base(location)+".trashinfo"))
+		return err
+	}
+	return nil
+}
+
+// writeExclusive creates path with the given content, failing if it exists
+func writeExclusive(path string, content string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// MoveFile renames src to dst, creating the parent folders of dst.
+// If a rename is not possible (e.g. across filesystems) the file is copied
+// with its permissions and timestamps and the source is removed.
+func MoveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("Error creating directory for %s: %v", dst, err)
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("Error moving %s: %s already exists", src, dst)
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := CopyFile(src, dst); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("Error moving %s to %s: %v", src, dst, err)
+	}
+	return os.Remove(src)
+}
+
+// ReplaceFile moves src over dst with a single rename, so dst always holds
+// either its old or its new content. Across filesystems src is first copied
+// to a temporary file next to dst.
+func ReplaceFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("Error creating directory for %s: %v", dst, err)
+	}
+	if err := os.Rename(src, dst); err == nil {
+		fsutil.SyncDir(filepath.Dir(dst))
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), fsutil.TempPattern)
+	if err != nil {
+		return fmt.Errorf("Error replacing %s: %v", dst, err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpPath)
+	if err := CopyFile(src, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error replacing %s: %v", dst, err)
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error replacing %s: %v", dst, err)
+	}
+	fsutil.SyncDir(filepath.Dir(dst))
+	return os.Remove(src)
+}
+
+// CopyFile copies src to dst including permissions and modification time
+func CopyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// Restore moves a removed file from its location back to path.
+// Trash info files of the freedesktop.org trash are cleaned up.
+func Restore(location, path string) error {
+	if err := MoveFile(location, path); err != nil {
+		return err
+	}
+
+	filesDir := filepath.Dir(location)
+	if filepath.Base(filesDir) == "files" {
+		info := filepath.Join(filepath.Dir(filesDir), "info", filepath.Base(location)+".trashinfo")
+		if err := os.Remove(info); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing trash info %s: %v", info, err)
+		}
+	}
+	return nil
+}
+
+// Purge removes all quarantine batches older than the given age
+// and returns the number of removed batches
+func Purge(quarantineDir string, olderThan time.Duration) (int, error) {
+	batches, err := os.ReadDir(quarantineDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Error reading quarantine %s: %v", quarantineDir, err)
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	purged := 0
+	for _, batch := range batches {
+		if !batch.IsDir() {
+			continue
+		}
+		created, err := time.ParseInLocation(RunIDFormat, batch.Name(), time.Local)
+		if err != nil {
+			// Not a quarantine batch
+			continue
+		}
+		if created.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(quarantineDir, batch.Name())); err != nil {
+			return purged, fmt.Errorf("Error purging %s: %v", batch.Name(), err)
+		}
+		purged++
+	}
+	return purged, nil
+}
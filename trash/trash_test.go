@@ -0,0 +1,182 @@
+package trash
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frommie/rawmanager/config"
+)
+
+func createTestFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("RAW"), 0644); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       config.DeleteMode
+		wantMoved  bool
+		wantTarget func(root, trashDir string) string
+	}{
+		{
+			name:      "Remove deletes permanently",
+			mode:      config.DeleteModeRemove,
+			wantMoved: false,
+		},
+		{
+			name:      "Quarantine mirrors the library path",
+			mode:      config.DeleteModeQuarantine,
+			wantMoved: true,
+			wantTarget: func(root, trashDir string) string {
+				return filepath.Join(root, config.DefaultQuarantineDir, "20240504-120000", "shoot", "raw", "test.RAF")
+			},
+		},
+		{
+			name:      "Trash moves into the home trash",
+			mode:      config.DeleteModeTrash,
+			wantMoved: true,
+			wantTarget: func(root, trashDir string) string {
+				return filepath.Join(trashDir, "Trash", "files", "test.RAF")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootDir := t.TempDir()
+			dataHome := t.TempDir()
+			t.Setenv("XDG_DATA_HOME", dataHome)
+
+			path := filepath.Join(rootDir, "shoot", "raw", "test.RAF")
+			createTestFile(t, path)
+
+			cfg := config.NewDefaultConfig()
+			cfg.Delete.Mode = tt.mode
+			remover, err := New(cfg, rootDir, "20240504-120000")
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			location := remove(t, remover, path)
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s still exists", path)
+			}
+			if !tt.wantMoved {
+				if location != "" {
+					t.Errorf("Remove() location = %s, want none", location)
+				}
+				return
+			}
+
+			want := tt.wantTarget(rootDir, dataHome)
+			if location != want {
+				t.Errorf("Remove() location = %s, want %s", location, want)
+			}
+			if data, err := os.ReadFile(location); err != nil || string(data) != "RAW" {
+				t.Errorf("Moved file not readable: %v", err)
+			}
+		})
+	}
+}
+
+// remove reserves a location for path and removes it
+func remove(t *testing.T, remover Remover, path string) string {
+	t.Helper()
+	location, err := remover.Reserve(path)
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if err := remover.Remove(path, location); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	return location
+}
+
+func TestTrashInfo(t *testing.T) {
+	rootDir := t.TempDir()
+	dataHome := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", dataHome)
+
+	cfg := config.NewDefaultConfig()
+	cfg.Delete.Mode = config.DeleteModeTrash
+	remover, err := New(cfg, rootDir, "20240504-120000")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// Two files with the same name must not collide in the trash
+	for _, dir := range []string{"a b", "c"} {
+		path := filepath.Join(rootDir, dir, "test.RAF")
+		createTestFile(t, path)
+		remove(t, remover, path)
+	}
+
+	info, err := os.ReadFile(filepath.Join(dataHome, "Trash", "info", "test.RAF.trashinfo"))
+	if err != nil {
+		t.Fatalf("Missing trash info: %v", err)
+	}
+	if !strings.HasPrefix(string(info), "[Trash Info]\n") || !strings.Contains(string(info), "a%20b/test.RAF") {
+		t.Errorf("Unexpected trash info: %s", info)
+	}
+	if _, err := os.Stat(filepath.Join(dataHome, "Trash", "files", "test.RAF.2")); err != nil {
+		t.Errorf("Second file not found in trash: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataHome, "Trash", "info", "test.RAF.2.trashinfo")); err != nil {
+		t.Errorf("Second trash info not found: %v", err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	quarantineDir := t.TempDir()
+
+	old := time.Now().Add(-48 * time.Hour).Format(RunIDFormat)
+	recent := time.Now().Format(RunIDFormat)
+	createTestFile(t, filepath.Join(quarantineDir, old, "raw", "old.RAF"))
+	createTestFile(t, filepath.Join(quarantineDir, recent, "raw", "new.RAF"))
+	createTestFile(t, filepath.Join(quarantineDir, "unrelated", "file.txt"))
+
+	purged, err := Purge(quarantineDir, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Purge() error = %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("Purge() = %d, want 1", purged)
+	}
+	if _, err := os.Stat(filepath.Join(quarantineDir, old)); !os.IsNotExist(err) {
+		t.Error("Old batch should have been purged")
+	}
+	for _, dir := range []string{recent, "unrelated"} {
+		if _, err := os.Stat(filepath.Join(quarantineDir, dir)); err != nil {
+			t.Errorf("%s should have been kept: %v", dir, err)
+		}
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "backup", "test.JPG")
+	dst := filepath.Join(dir, "test.JPG")
+	createTestFile(t, src)
+	if err := os.WriteFile(dst, []byte("SMALL"), 0644); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	if err := ReplaceFile(src, dst); err != nil {
+		t.Fatalf("ReplaceFile() error = %v", err)
+	}
+	if data, err := os.ReadFile(dst); err != nil || string(data) != "RAW" {
+		t.Errorf("%s = %q (%v), want the replacement", dst, data, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("%s still exists", src)
+	}
+}
@@ -0,0 +1,101 @@
+package xmp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ExtendedHeader starts APP1 segments with a chunk of extended XMP
+	ExtendedHeader = "http://ns.adobe.com/xmp/extension/\x00"
+
+	// guidLength is the length of the GUID, the MD5 of the extended XMP in hex
+	guidLength = 32
+)
+
+// IsStandardSegment reports whether an APP1 payload holds the standard XMP packet
+func IsStandardSegment(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(NsXMP))
+}
+
+// IsExtendedSegment reports whether an APP1 payload holds a chunk of extended XMP
+func IsExtendedSegment(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(ExtendedHeader))
+}
+
+// assembleExtended reassembles the extended XMP announced by the standard
+// packet via xmpNote:HasExtendedXMP from the chunks of the APP1 payloads.
+// Chunks may appear in any order, the result is verified against the MD5
+// given by the GUID.
+func assembleExtended(guid string, payloads [][]byte) ([]byte, error) {
+	type chunk struct {
+		size, offset uint32
+		part         []byte
+	}
+	var chunks []chunk
+	available := 0
+	for _, payload := range payloads {
+		data := payload[len(ExtendedHeader):]
+		if len(data) < guidLength+8 {
+			return nil, fmt.Errorf("Invalid extended XMP chunk: %d bytes", len(data))
+		}
+		if !strings.EqualFold(string(data[:guidLength]), guid) {
+			continue
+		}
+		c := chunk{
+			size:   binary.BigEndian.Uint32(data[guidLength:]),
+			offset: binary.BigEndian.Uint32(data[guidLength+4:]),
+			part:   data[guidLength+8:],
+		}
+		chunks = append(chunks, c)
+		available += len(c.part)
+	}
+
+	var data []byte
+	received := 0
+	for _, c := range chunks {
+		if data == nil {
+			// The chunks must hold the full size, a corrupt header must not
+			// force a huge allocation
+			if uint64(c.size) > uint64(available) {
+				return nil, fmt.Errorf("Extended XMP %s incomplete: %d of %d bytes", guid, available, c.size)
+			}
+			data = make([]byte, c.size)
+		}
+		if uint32(len(data)) != c.size || uint64(c.offset)+uint64(len(c.part)) > uint64(c.size) {
+			return nil, fmt.Errorf("Invalid extended XMP chunk at offset %d", c.offset)
+		}
+		copy(data[c.offset:], c.part)
+		received += len(c.part)
+	}
+
+	if data == nil {
+		return nil, fmt.Errorf("Extended XMP %s not found", guid)
+	}
+	if received != len(data) {
+		return nil, fmt.Errorf("Extended XMP %s incomplete: %d of %d bytes", guid, received, len(data))
+	}
+	sum := md5.Sum(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), guid) {
+		return nil, fmt.Errorf("Extended XMP %s failed the MD5 check", guid)
+	}
+	return data, nil
+}
+
+// extendedGUID returns the GUID of the extended XMP announced by a standard
+// packet, or "" if there is none
+func extendedGUID(data []byte) string {
+	packet, err := Parse(data)
+	if err != nil {
+		return ""
+	}
+	guid, _ := packet.Get(NsXMPNote, "HasExtendedXMP")
+	if len(guid) != guidLength {
+		return ""
+	}
+	return guid
+}
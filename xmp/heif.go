@@ -0,0 +1,292 @@
+package xmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// heifXmpType is the content type of the XMP item of a HEIF file
+const heifXmpType = "application/rdf+xml"
+
+// box is an ISOBMFF box with its payload
+type box struct {
+	typ     string
+	payload []byte
+}
+
+// IsHeif reports whether data starts with the ftyp box of an ISOBMFF file
+// such as HEIF/HEIC
+func IsHeif(data []byte) bool {
+	return len(data) >= 12 && string(data[4:8]) == "ftyp"
+}
+
+// ExtractHeifXmp extracts the XMP item of a HEIF file. The item is found by
+// its content type in the iinf box of the top-level meta box, its data is
+// located through the iloc box, either in the file or in the idat box.
+func ExtractHeifXmp(data []byte) ([]byte, error) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	meta := findBox(boxes, "meta")
+	if meta == nil {
+		return nil, fmt.Errorf("No meta box found in HEIF file")
+	}
+	// meta is a full box, its children follow version and flags
+	if len(meta.payload) < 4 {
+		return nil, fmt.Errorf("Invalid HEIF meta box")
+	}
+	children, err := readBoxes(meta.payload[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	iinf := findBox(children, "iinf")
+	iloc := findBox(children, "iloc")
+	if iinf == nil || iloc == nil {
+		return nil, fmt.Errorf("No XMP data found")
+	}
+	itemID, err := heifXmpItem(iinf.payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var idat []byte
+	if b := findBox(children, "idat"); b != nil {
+		idat = b.payload
+	}
+	xmpData, err := heifItemData(iloc.payload, itemID, data, idat)
+	if err != nil {
+		return nil, err
+	}
+	xmpData = bytes.TrimSpace(bytes.TrimRight(xmpData, "\x00"))
+	if len(xmpData) == 0 {
+		return nil, fmt.Errorf("No XMP data found")
+	}
+	return xmpData, nil
+}
+
+// readBoxes splits data into consecutive boxes
+func readBoxes(data []byte) ([]box, error) {
+	var boxes []box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("Truncated HEIF box header")
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			// The last box extends to the end of the file
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("Truncated HEIF box header")
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, fmt.Errorf("Invalid size %d of HEIF box %q", size, typ)
+		}
+		boxes = append(boxes, box{typ: typ, payload: data[header:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// findBox returns the first box of the given type, or nil
+func findBox(boxes []box, typ string) *box {
+	for i := range boxes {
+		if boxes[i].typ == typ {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// heifXmpItem returns the ID of the XMP item listed in an iinf box
+func heifXmpItem(iinf []byte) (uint32, error) {
+	if len(iinf) < 6 {
+		return 0, fmt.Errorf("Invalid HEIF iinf box")
+	}
+	// Version 0 counts the entries in 16 bits, later versions in 32 bits
+	offset := 6
+	if iinf[0] != 0 {
+		offset = 8
+	}
+	if len(iinf) < offset {
+		return 0, fmt.Errorf("Invalid HEIF iinf box")
+	}
+	entries, err := readBoxes(iinf[offset:])
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		if entry.typ != "infe" {
+			continue
+		}
+		id, contentType, ok := parseInfe(entry.payload)
+		if ok && contentType == heifXmpType {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("No XMP data found")
+}
+
+// parseInfe reads the item ID and content type of an infe box
+func parseInfe(infe []byte) (uint32, string, bool) {
+	if len(infe) < 4 {
+		return 0, "", false
+	}
+	version, p := infe[0], infe[4:]
+
+	if version < 2 {
+		// item_ID, item_protection_index, item_name, content_type
+		if len(p) < 4 {
+			return 0, "", false
+		}
+		id := uint32(binary.BigEndian.Uint16(p))
+		_, rest := cstring(p[4:])
+		contentType, _ := cstring(rest)
+		return id, contentType, true
+	}
+
+	// item_ID, item_protection_index, item_type, item_name and for mime
+	// items content_type
+	var id uint32
+	if version == 2 {
+		if len(p) < 2 {
+			return 0, "", false
+		}
+		id, p = uint32(binary.BigEndian.Uint16(p)), p[2:]
+	} else {
+		if len(p) < 4 {
+			return 0, "", false
+		}
+		id, p = binary.BigEndian.Uint32(p), p[4:]
+	}
+	if len(p) < 6 || string(p[2:6]) != "mime" {
+		return id, "", true
+	}
+	_, rest := cstring(p[6:])
+	contentType, _ := cstring(rest)
+	return id, contentType, true
+}
+
+// cstring splits a null-terminated string off data
+func cstring(data []byte) (string, []byte) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return string(data), nil
+	}
+	return string(data[:end]), data[end+1:]
+}
+
+// heifItemData concatenates the extents of an item listed in an iloc box.
+// Construction method 0 addresses the file, method 1 the idat box.
+func heifItemData(iloc []byte, itemID uint32, file, idat []byte) ([]byte, error) {
+	r := &boxReader{data: iloc}
+	version := r.uint(1)
+	r.skip(3) // flags
+	sizes := r.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0x0f)
+	sizes = r.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0x0f)
+	}
+	count := r.uint(2)
+	if version == 2 {
+		count = r.uint(4)
+	}
+
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		id := r.uint(2)
+		if version == 2 {
+			id = r.uint(4)
+		}
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = r.uint(2) & 0x0f
+		}
+		r.skip(2) // data_reference_index
+		baseOffset := r.uint(baseOffsetSize)
+		extents := r.uint(2)
+
+		var data []byte
+		for e := uint64(0); e < extents && r.err == nil; e++ {
+			r.skip(indexSize)
+			offset := baseOffset + r.uint(offsetSize)
+			length := r.uint(lengthSize)
+			if id != uint64(itemID) {
+				continue
+			}
+
+			var source []byte
+			switch method {
+			case 0:
+				source = file
+			case 1:
+				source = idat
+			default:
+				return nil, fmt.Errorf("Unsupported HEIF construction method %d", method)
+			}
+			if offset > uint64(len(source)) {
+				return nil, fmt.Errorf("HEIF item %d out of bounds", itemID)
+			}
+			if length == 0 {
+				// Length 0 extends to the end of the source
+				length = uint64(len(source)) - offset
+			}
+			if length > uint64(len(source))-offset {
+				return nil, fmt.Errorf("HEIF item %d out of bounds", itemID)
+			}
+			data = append(data, source[offset:offset+length]...)
+		}
+		if id == uint64(itemID) && r.err == nil {
+			return data, nil
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return nil, fmt.Errorf("HEIF item %d not located", itemID)
+}
+
+// boxReader reads big-endian fields of variable size from a box payload
+type boxReader struct {
+	data []byte
+	err  error
+}
+
+// uint reads an unsigned integer of size bytes, 0 bytes read as 0
+func (r *boxReader) uint(size int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if size > 8 || len(r.data) < size {
+		r.err = fmt.Errorf("Truncated HEIF iloc box")
+		return 0
+	}
+	var v uint64
+	for _, b := range r.data[:size] {
+		v = v<<8 | uint64(b)
+	}
+	r.data = r.data[size:]
+	return v
+}
+
+// skip discards size bytes
+func (r *boxReader) skip(size int) {
+	if r.err != nil {
+		return
+	}
+	if len(r.data) < size {
+		r.err = fmt.Errorf("Truncated HEIF iloc box")
+		return
+	}
+	r.data = r.data[size:]
+}
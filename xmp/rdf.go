@@ -0,0 +1,219 @@
+package xmp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Namespaces of the properties read by rawmanager
+const (
+	NsRDF            = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	NsXMP            = "http://ns.adobe.com/xap/1.0/"
+	NsMicrosoftPhoto = "http://ns.microsoft.com/photo/1.0/"
+	NsDC             = "http://purl.org/dc/elements/1.1/"
+	NsLightroom      = "http://ns.adobe.com/lightroom/1.0/"
+	NsDigiKam        = "http://www.digikam.org/ns/1.0/"
+	NsDynamicMedia   = "http://ns.adobe.com/xmp/1.0/DynamicMedia/"
+	NsXMPNote        = "http://ns.adobe.com/xmp/note/"
+	nsXML            = "http://www.w3.org/XML/1998/namespace"
+)
+
+// Property identifies a top-level XMP property by namespace URI and local
+// name, independent of the prefix used in the packet
+type Property struct {
+	Space string
+	Local string
+}
+
+// Packet holds the top-level properties of all rdf:Description blocks of an
+// XMP packet. Simple values are stored as a single value, rdf:Bag and rdf:Seq
+// containers as their items in order and rdf:Alt containers with the
+// x-default item first.
+type Packet struct {
+	props map[Property][]string
+}
+
+// node is an element of the parsed XML tree
+type node struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*node
+	text     strings.Builder
+}
+
+// Parse reads an XMP packet. Properties may be written as attributes or
+// elements and may be spread across several rdf:Description blocks. Data
+// holding several packets, such as a standard packet followed by its
+// extended XMP, is read as one packet with the first packet taking
+// precedence.
+func Parse(data []byte) (*Packet, error) {
+	root, err := parseTree(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing XMP data: %v", err)
+	}
+
+	rdfs := findRDF(root, nil)
+	if len(rdfs) == 0 {
+		return nil, fmt.Errorf("Error parsing XMP data: no rdf:RDF element found")
+	}
+
+	p := &Packet{props: map[Property][]string{}}
+	for _, rdf := range rdfs {
+		for _, desc := range rdf.children {
+			if desc.name.Space != NsRDF || desc.name.Local != "Description" {
+				continue
+			}
+			for _, attr := range desc.attrs {
+				if isSyntaxName(attr.Name) {
+					continue
+				}
+				p.add(Property{attr.Name.Space, attr.Name.Local}, []string{attr.Value})
+			}
+			for _, child := range desc.children {
+				p.add(Property{child.name.Space, child.name.Local}, propertyValues(child))
+			}
+		}
+	}
+	return p, nil
+}
+
+// Get returns the value of a simple property, or the default item of an
+// array property
+func (p *Packet) Get(space, local string) (string, bool) {
+	values := p.props[Property{space, local}]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// Values returns all items of an array property, or the value of a simple property
+func (p *Packet) Values(space, local string) []string {
+	return p.props[Property{space, local}]
+}
+
+// add stores the values of a property. The first occurrence wins if a
+// property is set in several descriptions.
+func (p *Packet) add(prop Property, values []string) {
+	if _, exists := p.props[prop]; exists || values == nil {
+		return
+	}
+	p.props[prop] = values
+}
+
+// propertyValues returns the values of a property element. Structs and
+// resource references carry no simple value and yield nil.
+func propertyValues(n *node) []string {
+	for _, attr := range n.attrs {
+		if attr.Name.Space == NsRDF && (attr.Name.Local == "resource" || attr.Name.Local == "parseType") {
+			return nil
+		}
+	}
+
+	for _, child := range n.children {
+		if child.name.Space != NsRDF {
+			return nil
+		}
+		switch child.name.Local {
+		case "Bag", "Seq":
+			values := []string{}
+			for _, li := range items(child) {
+				values = append(values, strings.TrimSpace(li.text.String()))
+			}
+			return values
+		case "Alt":
+			values := []string{}
+			for _, li := range items(child) {
+				value := strings.TrimSpace(li.text.String())
+				if langOf(li) == "x-default" {
+					values = append([]string{value}, values...)
+				} else {
+					values = append(values, value)
+				}
+			}
+			return values
+		default:
+			return nil
+		}
+	}
+
+	if len(n.children) > 0 {
+		return nil
+	}
+	return []string{strings.TrimSpace(n.text.String())}
+}
+
+// items returns the rdf:li elements of a container
+func items(container *node) []*node {
+	var lis []*node
+	for _, child := range container.children {
+		if child.name.Space == NsRDF && child.name.Local == "li" {
+			lis = append(lis, child)
+		}
+	}
+	return lis
+}
+
+// langOf returns the xml:lang qualifier of an element
+func langOf(n *node) string {
+	for _, attr := range n.attrs {
+		if attr.Name.Space == nsXML && attr.Name.Local == "lang" {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// isSyntaxName reports whether an attribute belongs to RDF or XML syntax
+// rather than being a property
+func isSyntaxName(name xml.Name) bool {
+	return name.Space == NsRDF || name.Space == nsXML || name.Space == "xmlns" || name.Local == "xmlns"
+}
+
+// findRDF appends the rdf:RDF elements of the tree to found in document order
+func findRDF(n *node, found []*node) []*node {
+	if n.name.Space == NsRDF && n.name.Local == "RDF" {
+		return append(found, n)
+	}
+	for _, child := range n.children {
+		found = findRDF(child, found)
+	}
+	return found
+}
+
+// parseTree reads the XML document into a tree with resolved namespaces
+func parseTree(data []byte) (*node, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	root := &node{}
+	stack := []*node{root}
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parent := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name, attrs: t.Attr}
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			parent.text.Write(t)
+		}
+	}
+
+	if len(root.children) == 0 {
+		return nil, fmt.Errorf("no XML element found")
+	}
+	return root, nil
+}
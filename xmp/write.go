@@ -0,0 +1,279 @@
+package xmp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/frommie/rawmanager/fsutil"
+)
+
+// emptyPacket is the skeleton of new sidecars
+const emptyPacket = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="rawmanager">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+// attrPattern matches a prefixed attribute within a start tag
+var attrPattern = regexp.MustCompile(`\s+([A-Za-z_][\w.-]*):([A-Za-z_][\w.-]*)\s*=\s*("[^"]*"|'[^']*')`)
+
+// edit replaces data[start:end] with text
+type edit struct {
+	start, end int
+	text       string
+}
+
+// description is an rdf:Description block found while scanning a packet
+type description struct {
+	start, end int               // Range of the start tag
+	scope      map[string]string // Namespace prefixes in scope, including the tag's own
+	children   []edit            // Property elements to remove
+}
+
+// Update returns the XMP packet data with rating, label and keywords of meta.
+// Rating and label replace existing values if set, keywords are added to the
+// existing ones. All other content is preserved. Empty data creates a new
+// packet, data is returned as is if nothing changes.
+func Update(data []byte, meta *Metadata) ([]byte, error) {
+	packet := data
+	if len(bytes.TrimSpace(packet)) == 0 {
+		packet = []byte(emptyPacket)
+	}
+	existing, err := GetMetadata(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the properties that change
+	replace := map[Property]bool{}
+	if meta.Rated && (!existing.Rated || existing.Rating != meta.Rating) {
+		replace[Property{NsXMP, "Rating"}] = true
+	}
+	if meta.Label != "" && meta.Label != existing.Label {
+		replace[Property{NsXMP, "Label"}] = true
+	}
+	keywords := existing.Keywords
+	for _, keyword := range meta.Keywords {
+		if !containsFold(keywords, keyword) {
+			keywords = append(keywords, keyword)
+		}
+	}
+	if len(keywords) > len(existing.Keywords) {
+		replace[Property{NsDC, "subject"}] = true
+	}
+	if len(replace) == 0 {
+		return data, nil
+	}
+
+	descriptions, err := scanDescriptions(packet, replace)
+	if err != nil {
+		return nil, err
+	}
+	if len(descriptions) == 0 {
+		return nil, fmt.Errorf("Error updating XMP data: no rdf:Description found")
+	}
+
+	var edits []edit
+	for i, desc := range descriptions {
+		edits = append(edits, desc.children...)
+
+		// Drop replaced attributes, the first description receives the new values
+		tag := attrPattern.ReplaceAllStringFunc(string(packet[desc.start:desc.end]), func(attr string) string {
+			m := attrPattern.FindStringSubmatch(attr)
+			if replace[Property{desc.scope[m[1]], m[2]}] {
+				return ""
+			}
+			return attr
+		})
+		if i == 0 {
+			tag = insertProperties(tag, desc.scope, replace, meta, keywords)
+		}
+		edits = append(edits, edit{desc.start, desc.end, tag})
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	result := append([]byte{}, packet...)
+	for _, e := range edits {
+		result = append(result[:e.start], append([]byte(e.text), result[e.end:]...)...)
+	}
+	return result, nil
+}
+
+// UpdateFile updates the XMP sidecar at path with rating, label and keywords
+// of meta, creating it if needed. The file is replaced atomically.
+func UpdateFile(path string, meta *Metadata) error {
+	mode := os.FileMode(0644)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Error reading XMP file: %v", err)
+	}
+
+	updated, err := Update(data, meta)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(updated, data) {
+		return nil
+	}
+
+	if err := fsutil.WriteFile(path, updated, mode); err != nil {
+		return fmt.Errorf("Error writing XMP file: %v", err)
+	}
+	return nil
+}
+
+// scanDescriptions returns the rdf:Description blocks of a packet together
+// with their property elements contained in replace
+func scanDescriptions(data []byte, replace map[Property]bool) ([]description, error) {
+	type element struct {
+		name  xml.Name
+		start int
+		scope map[string]string
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	stack := []element{{scope: map[string]string{}}}
+	var descriptions []description
+
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing XMP data: %v", err)
+		}
+		end := int(d.InputOffset())
+		parent := stack[len(stack)-1]
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			scope := parent.scope
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" {
+					if len(scope) == len(parent.scope) {
+						scope = copyScope(parent.scope)
+					}
+					scope[attr.Name.Local] = attr.Value
+				}
+			}
+			if parent.name.Space == NsRDF && parent.name.Local == "RDF" &&
+				t.Name.Space == NsRDF && t.Name.Local == "Description" {
+				descriptions = append(descriptions, description{start: start, end: end, scope: scope})
+			}
+			stack = append(stack, element{name: t.Name, start: start, scope: scope})
+
+		case xml.EndElement:
+			current := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			parent = stack[len(stack)-1]
+			if parent.name.Space == NsRDF && parent.name.Local == "Description" &&
+				replace[Property{current.name.Space, current.name.Local}] {
+				desc := &descriptions[len(descriptions)-1]
+				desc.children = append(desc.children, edit{start: trimLineStart(data, current.start), end: end})
+			}
+		}
+	}
+	return descriptions, nil
+}
+
+// insertProperties adds the replaced properties as elements to the start
+// tag of a description, declaring missing namespaces on the tag
+func insertProperties(tag string, scope map[string]string, replace map[Property]bool, meta *Metadata, keywords []string) string {
+	var decls []string
+	prefixOf := func(space, preferred string) string {
+		for prefix, uri := range scope {
+			if uri == space {
+				return prefix
+			}
+		}
+		prefix := preferred
+		for i := 1; scope[prefix] != ""; i++ {
+			prefix = fmt.Sprintf("%s%d", preferred, i)
+		}
+		scope = copyScope(scope)
+		scope[prefix] = space
+		decls = append(decls, fmt.Sprintf(` xmlns:%s="%s"`, prefix, space))
+		return prefix
+	}
+
+	var content strings.Builder
+	if replace[Property{NsXMP, "Rating"}] {
+		prefix := prefixOf(NsXMP, "xmp")
+		fmt.Fprintf(&content, "\n   <%s:Rating>%d</%s:Rating>", prefix, meta.Rating, prefix)
+	}
+	if replace[Property{NsXMP, "Label"}] {
+		prefix := prefixOf(NsXMP, "xmp")
+		fmt.Fprintf(&content, "\n   <%s:Label>%s</%s:Label>", prefix, escape(meta.Label), prefix)
+	}
+	if replace[Property{NsDC, "subject"}] {
+		dc, rdf := prefixOf(NsDC, "dc"), prefixOf(NsRDF, "rdf")
+		fmt.Fprintf(&content, "\n   <%s:subject>\n    <%s:Bag>", dc, rdf)
+		for _, keyword := range keywords {
+			fmt.Fprintf(&content, "\n     <%s:li>%s</%s:li>", rdf, escape(keyword), rdf)
+		}
+		fmt.Fprintf(&content, "\n    </%s:Bag>\n   </%s:subject>", rdf, dc)
+	}
+
+	if strings.HasSuffix(tag, "/>") {
+		name := strings.Fields(strings.TrimPrefix(tag, "<"))[0]
+		name = strings.TrimSuffix(name, "/>")
+		return strings.TrimSuffix(tag, "/>") + strings.Join(decls, "") + ">" + content.String() + "\n  </" + name + ">"
+	}
+	return strings.TrimSuffix(tag, ">") + strings.Join(decls, "") + ">" + content.String()
+}
+
+// trimLineStart extends start over the indentation and line break before it
+func trimLineStart(data []byte, start int) int {
+	for start > 0 && (data[start-1] == ' ' || data[start-1] == '\t') {
+		start--
+	}
+	if start > 0 && data[start-1] == '\n' {
+		start--
+		if start > 0 && data[start-1] == '\r' {
+			start--
+		}
+	}
+	return start
+}
+
+// copyScope copies a namespace scope
+func copyScope(scope map[string]string) map[string]string {
+	copied := make(map[string]string, len(scope)+1)
+	for prefix, uri := range scope {
+		copied[prefix] = uri
+	}
+	return copied
+}
+
+// containsFold reports whether values contains value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// escape escapes text for XML character data
+func escape(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
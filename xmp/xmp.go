@@ -2,30 +2,27 @@ package xmp
 
 import (
 	"bytes"
-	"encoding/xml"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/dsoprea/go-jpeg-image-structure/v2"
+	"github.com/frommie/rawmanager/rating"
 )
 
-type XmpMeta struct {
-	XMLName xml.Name `xml:"xmpmeta"`
-	RDF     struct {
-		Description struct {
-			Rating   string `xml:"http://ns.adobe.com/xap/1.0/ Rating"`
-			MSRating string `xml:"http://ns.microsoft.com/photo/1.0/ Rating"`
-		} `xml:"Description"`
-	} `xml:"RDF"`
-}
-
-// ExtractXmpData extracts XMP data from a file
+// ExtractXmpData extracts XMP data from a JPEG or HEIF file. Extended XMP
+// split across several APP1 segments is reassembled and appended to the
+// standard packet, it is left out if it is incomplete or fails the MD5 check.
 func ExtractXmpData(file *os.File) ([]byte, error) {
 	data, err := io.ReadAll(file)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading file: %v", err)
 	}
+	if IsHeif(data) {
+		return ExtractHeifXmp(data)
+	}
 
 	jmp := jpegstructure.NewJpegMediaParser()
 	intfc, err := jmp.ParseBytes(data)
@@ -36,24 +33,29 @@ func ExtractXmpData(file *os.File) ([]byte, error) {
 	// Get list of segments
 	sl := intfc.(*jpegstructure.SegmentList)
 	var xmpData []byte
+	var extended [][]byte
 
-	// Search for the APP1 segment with XMP data
+	// Search for the APP1 segments with XMP data
 	for _, segment := range sl.Segments() {
-		if segment.MarkerId == 0xE1 { // APP1 marker ID is 0xE1
-			payload := segment.Data
-			if bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xap/1.0/")) {
-				// Remove all null bytes from the data
-				cleanData := bytes.Map(func(r rune) rune {
-					if r == 0 {
-						return -1
-					}
-					return r
-				}, payload[len("http://ns.adobe.com/xap/1.0/"):])
-
-				// Remove whitespace at the beginning and end
-				xmpData = bytes.TrimSpace(cleanData)
-				break
-			}
+		if segment.MarkerId != 0xE1 { // APP1 marker ID is 0xE1
+			continue
+		}
+		payload := segment.Data
+		if IsExtendedSegment(payload) {
+			extended = append(extended, payload)
+			continue
+		}
+		if xmpData == nil && IsStandardSegment(payload) {
+			// Remove all null bytes from the data
+			cleanData := bytes.Map(func(r rune) rune {
+				if r == 0 {
+					return -1
+				}
+				return r
+			}, payload[len(NsXMP):])
+
+			// Remove whitespace at the beginning and end
+			xmpData = bytes.TrimSpace(cleanData)
 		}
 	}
 
@@ -61,36 +63,220 @@ func ExtractXmpData(file *os.File) ([]byte, error) {
 		return nil, fmt.Errorf("No XMP data found")
 	}
 
+	if guid := extendedGUID(xmpData); guid != "" && len(extended) > 0 {
+		if extendedData, err := assembleExtended(guid, extended); err == nil {
+			xmpData = append(append(xmpData, '\n'), bytes.TrimSpace(extendedData)...)
+		}
+	}
+
 	return xmpData, nil
 }
 
-// GetRating reads the rating from XMP data
-func GetRating(xmpData []byte) (int, error) {
-	var xmp XmpMeta
-	if err := xml.Unmarshal(xmpData, &xmp); err != nil {
-		return 0, fmt.Errorf("Error parsing XMP data: %v", err)
+// Pick is the pick state of an image in a culling tool
+type Pick string
+
+const (
+	// Unflagged images carry no pick or reject flag
+	Unflagged Pick = "unflagged"
+
+	// Picked images were flagged as keepers
+	Picked Pick = "picked"
+
+	// Rejected images were flagged as rejects
+	Rejected Pick = "rejected"
+)
+
+// Metadata is the culling information of an XMP packet
+type Metadata struct {
+	Rating   int      // Star rating, -1 marks rejected images
+	Rated    bool     // Whether the packet carries a rating at all
+	Label    string   // Color label (xmp:Label)
+	Keywords []string // Keywords (dc:subject)
+	Pick     Pick     // Pick flag (digiKam:PickLabel, xmpDM:pick, xmpDM:good)
+
+	// Scale is the rating scale the rating was read in, e.g. rating.ScaleStars
+	// or rating.ScaleMicrosoft; Percent holds the original value of
+	// percent-based scales, whose Rating is set by Normalize. Empty for star
+	// ratings of other editors.
+	Scale   string
+	Percent int
+
+	// HierarchicalKeywords are Lightroom keyword paths (lr:hierarchicalSubject),
+	// e.g. "Clients|Delivered"
+	HierarchicalKeywords []string
+}
+
+// HasKeyword reports whether the image is tagged with keyword, either as flat
+// keyword or as full path or leaf of a hierarchical keyword. Keywords are
+// matched case-insensitively.
+func (m *Metadata) HasKeyword(keyword string) bool {
+	for _, k := range m.Keywords {
+		if strings.EqualFold(k, keyword) {
+			return true
+		}
+	}
+	for _, path := range m.HierarchicalKeywords {
+		leaf := path[strings.LastIndex(path, "|")+1:]
+		if strings.EqualFold(path, keyword) || strings.EqualFold(leaf, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMetadata reads rating, label, keywords and pick flag from XMP data
+func GetMetadata(xmpData []byte) (*Metadata, error) {
+	packet, err := Parse(xmpData)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &Metadata{Pick: Unflagged}
+	if err := readRating(packet, meta); err != nil {
+		return nil, err
 	}
+	meta.Label, _ = packet.Get(NsXMP, "Label")
+	meta.Keywords = keywords(packet.Values(NsDC, "subject"))
+	meta.HierarchicalKeywords = keywords(packet.Values(NsLightroom, "hierarchicalSubject"))
+	meta.Pick = readPick(packet)
+	return meta, nil
+}
 
+// keywords returns the non-empty items of a keyword bag
+func keywords(items []string) []string {
+	var result []string
+	for _, item := range items {
+		if keyword := strings.TrimSpace(item); keyword != "" {
+			result = append(result, keyword)
+		}
+	}
+	return result
+}
+
+// readRating sets the rating of meta from the Adobe or Microsoft rating
+func readRating(packet *Packet, meta *Metadata) error {
 	// Check for Adobe XMP Rating first
-	if xmp.RDF.Description.Rating != "" {
-		rating := 0
-		if _, err := fmt.Sscanf(xmp.RDF.Description.Rating, "%d", &rating); err != nil {
-			return 0, fmt.Errorf("Error parsing Adobe rating: %v", err)
+	if value, ok := packet.Get(NsXMP, "Rating"); ok && value != "" {
+		stars := 0
+		if _, err := fmt.Sscanf(value, "%d", &stars); err != nil {
+			return fmt.Errorf("Error parsing Adobe rating: %v", err)
+		}
+		// -1 marks rejected images
+		if stars < -1 || stars > 5 {
+			return fmt.Errorf("Invalid Adobe rating: %d", stars)
 		}
-		return rating, nil
+		meta.Rating, meta.Rated, meta.Scale = stars, true, rating.ScaleStars
+		return nil
 	}
 
 	// If no Adobe rating, check for Microsoft rating
-	if xmp.RDF.Description.MSRating != "" {
+	if value, ok := packet.Get(NsMicrosoftPhoto, "Rating"); ok && value != "" {
 		var msRating int
-		if _, err := fmt.Sscanf(xmp.RDF.Description.MSRating, "%d", &msRating); err != nil {
-			return 0, fmt.Errorf("Error parsing Microsoft rating: %v", err)
+		if _, err := fmt.Sscanf(value, "%d", &msRating); err != nil {
+			return fmt.Errorf("Error parsing Microsoft rating: %v", err)
 		}
-		// Konvertiere Microsoft Rating (0-99) zu Standard Rating (1-5)
-		return (msRating + 24) / 25, nil
+		// The percentage is converted to stars by Normalize with the table
+		// configured for the scale
+		meta.Rated = true
+		meta.Scale, meta.Percent = rating.ScaleMicrosoft, msRating
+	}
+	return nil
+}
+
+// readPick returns the pick flag written by digiKam or as xmpDM pick metadata
+func readPick(packet *Packet) Pick {
+	// digiKam: 0 none, 1 rejected, 2 pending, 3 accepted
+	if value, ok := packet.Get(NsDigiKam, "PickLabel"); ok {
+		switch strings.TrimSpace(value) {
+		case "1":
+			return Rejected
+		case "3":
+			return Picked
+		}
+	}
+
+	// xmpDM:pick: 1 picked, -1 rejected, 0 none
+	if value, ok := packet.Get(NsDynamicMedia, "pick"); ok {
+		switch strings.TrimSpace(value) {
+		case "1":
+			return Picked
+		case "-1":
+			return Rejected
+		}
+	}
+
+	// xmpDM:good only marks keepers, false is no reject
+	if value, ok := packet.Get(NsDynamicMedia, "good"); ok && strings.EqualFold(strings.TrimSpace(value), "true") {
+		return Picked
+	}
+	return Unflagged
+}
+
+// GetRating reads the rating from XMP data, percentages are converted with
+// the Windows table
+func GetRating(xmpData []byte) (int, error) {
+	meta, err := GetMetadata(xmpData)
+	if err != nil {
+		return 0, err
+	}
+	if !meta.Rated {
+		return 0, fmt.Errorf("No rating found in XMP data")
+	}
+	if err := meta.Normalize(rating.Windows); err != nil {
+		return 0, err
+	}
+	return meta.Rating, nil
+}
+
+// Normalize converts a percent-based rating to stars with the given table
+func (m *Metadata) Normalize(scale rating.Scale) error {
+	if !m.Rated || m.Scale == "" || m.Scale == rating.ScaleStars {
+		return nil
+	}
+	stars, err := scale.Stars(m.Percent)
+	if err != nil {
+		return fmt.Errorf("Invalid %s rating: %v", m.Scale, err)
+	}
+	m.Rating = stars
+	return nil
+}
+
+// GetLabel reads the color label (xmp:Label) from XMP data
+func GetLabel(xmpData []byte) (string, error) {
+	meta, err := GetMetadata(xmpData)
+	if err != nil {
+		return "", err
+	}
+	return meta.Label, nil
+}
+
+// GetKeywords reads the keywords (dc:subject) from XMP data
+func GetKeywords(xmpData []byte) ([]string, error) {
+	meta, err := GetMetadata(xmpData)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Keywords, nil
+}
+
+// RawSidecarPaths returns the sidecar names editors use for a RAW file:
+// DSCF1234.RAF.xmp (darktable, RawTherapee) and DSCF1234.xmp (Lightroom,
+// FastRawViewer)
+func RawSidecarPaths(rawPath string) []string {
+	return []string{
+		rawPath + ".xmp",
+		strings.TrimSuffix(rawPath, filepath.Ext(rawPath)) + ".xmp",
+	}
+}
+
+// GetMetadataFromFile reads rating, label, keywords and pick flag from an XMP file
+func GetMetadataFromFile(xmpPath string) (*Metadata, error) {
+	data, err := os.ReadFile(xmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading XMP file: %v", err)
 	}
 
-	return 0, fmt.Errorf("No rating found in XMP data")
+	return GetMetadata(data)
 }
 
 func GetRatingFromFile(xmpPath string) (int, error) {
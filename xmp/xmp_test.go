@@ -1,10 +1,15 @@
 package xmp
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/frommie/rawmanager/rating"
+	"github.com/frommie/rawmanager/testutils"
 )
 
 func TestGetRatingFromFile(t *testing.T) {
@@ -24,6 +29,26 @@ func TestGetRatingFromFile(t *testing.T) {
 			want:    4,
 			wantErr: false,
 		},
+		{
+			name: "Rejected",
+			setupFunc: func(dir string) (string, error) {
+				xmpPath := filepath.Join(dir, "test.xmp")
+				err := CreateTestXMP(xmpPath, -1)
+				return xmpPath, err
+			},
+			want:    -1,
+			wantErr: false,
+		},
+		{
+			name: "Rating out of range",
+			setupFunc: func(dir string) (string, error) {
+				xmpPath := filepath.Join(dir, "test.xmp")
+				err := CreateTestXMP(xmpPath, 7)
+				return xmpPath, err
+			},
+			want:    0,
+			wantErr: true,
+		},
 		{
 			name: "Invalid XMP file",
 			setupFunc: func(dir string) (string, error) {
@@ -58,6 +83,362 @@ func TestGetRatingFromFile(t *testing.T) {
 	}
 }
 
+func TestGetLabelAndKeywords(t *testing.T) {
+	xmpData := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+    <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+        <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+            <xmp:Rating>3</xmp:Rating>
+            <xmp:Label>Red</xmp:Label>
+            <dc:subject>
+                <rdf:Bag>
+                    <rdf:li>portfolio</rdf:li>
+                    <rdf:li>print</rdf:li>
+                </rdf:Bag>
+            </dc:subject>
+        </rdf:Description>
+    </rdf:RDF>
+</x:xmpmeta>`)
+
+	label, err := GetLabel(xmpData)
+	if err != nil || label != "Red" {
+		t.Errorf("GetLabel() = %q, %v, want Red", label, err)
+	}
+
+	keywords, err := GetKeywords(xmpData)
+	if err != nil || len(keywords) != 2 || keywords[0] != "portfolio" || keywords[1] != "print" {
+		t.Errorf("GetKeywords() = %v, %v, want [portfolio print]", keywords, err)
+	}
+}
+
+func TestCorpus(t *testing.T) {
+	tests := []struct {
+		file       string
+		wantRating int
+		wantErr    bool
+		wantLabel  string
+		wantKeys   []string
+	}{
+		{file: "lightroom-classic.xmp", wantRating: 4, wantLabel: "Green", wantKeys: []string{"portfolio", "landscape"}},
+		{file: "capture-one.xmp", wantRating: 2, wantLabel: "Red", wantKeys: []string{"client-delivered"}},
+		{file: "darktable.xmp", wantRating: 1, wantKeys: []string{"darktable|format|raf"}},
+		{file: "camera-firmware.xmp", wantRating: 5},
+		{file: "windows-photos.xmp", wantRating: 4, wantKeys: []string{"print"}}, // MicrosoftPhoto:Rating 75
+		{file: "other-prefix.xmp", wantRating: 3, wantLabel: "Purple", wantKeys: []string{"web-only"}},
+		{file: "digikam.xmp", wantRating: 2, wantKeys: []string{"Wedding"}},
+		{file: "no-rating.xmp", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatalf("Setup failed: %v", err)
+			}
+
+			rating, err := GetRating(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetRating() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && rating != tt.wantRating {
+				t.Errorf("GetRating() = %d, want %d", rating, tt.wantRating)
+			}
+
+			label, err := GetLabel(data)
+			if err != nil || label != tt.wantLabel {
+				t.Errorf("GetLabel() = %q, %v, want %q", label, err, tt.wantLabel)
+			}
+
+			keywords, err := GetKeywords(data)
+			if err != nil || strings.Join(keywords, ",") != strings.Join(tt.wantKeys, ",") {
+				t.Errorf("GetKeywords() = %v, %v, want %v", keywords, err, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestGetMetadataPick(t *testing.T) {
+	tests := []struct {
+		name       string
+		properties string
+		want       Pick
+	}{
+		{name: "No flag", properties: `xmp:Rating="3"`, want: Unflagged},
+		{name: "digiKam accepted", properties: `digiKam:PickLabel="3"`, want: Picked},
+		{name: "digiKam rejected", properties: `digiKam:PickLabel="1"`, want: Rejected},
+		{name: "digiKam pending", properties: `digiKam:PickLabel="2"`, want: Unflagged},
+		{name: "xmpDM pick", properties: `xmpDM:pick="1"`, want: Picked},
+		{name: "xmpDM reject", properties: `xmpDM:pick="-1"`, want: Rejected},
+		{name: "xmpDM good", properties: `xmpDM:good="True"`, want: Picked},
+		{name: "xmpDM not good", properties: `xmpDM:good="false"`, want: Unflagged},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xmpData := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+  <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+    <rdf:Description rdf:about=""
+        xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+        xmlns:digiKam="http://www.digikam.org/ns/1.0/"
+        xmlns:xmpDM="http://ns.adobe.com/xmp/1.0/DynamicMedia/"
+        ` + tt.properties + `/>
+  </rdf:RDF>
+</x:xmpmeta>`)
+
+			meta, err := GetMetadata(xmpData)
+			if err != nil {
+				t.Fatalf("GetMetadata() error = %v", err)
+			}
+			if meta.Pick != tt.want {
+				t.Errorf("Pick = %q, want %q", meta.Pick, tt.want)
+			}
+		})
+	}
+}
+
+func TestMicrosoftRating(t *testing.T) {
+	// Windows writes 1, 25, 50, 75 and 99 for 1 to 5 stars, other tools 100
+	for stars, percent := range []int{0, 1, 25, 50, 75, 99, 100} {
+		xmpData := []byte(fmt.Sprintf(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+  <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+    <rdf:Description rdf:about=""
+        xmlns:MicrosoftPhoto="http://ns.microsoft.com/photo/1.0/"
+        MicrosoftPhoto:Rating="%d"/>
+  </rdf:RDF>
+</x:xmpmeta>`, percent))
+
+		// The percentage is read as is, whatever the table
+		meta, err := GetMetadata(xmpData)
+		if err != nil {
+			t.Fatalf("GetMetadata(%d) error = %v", percent, err)
+		}
+		if meta.Scale != "microsoft" || meta.Percent != percent {
+			t.Errorf("GetMetadata(%d) = %+v, want %d%% on the microsoft scale", percent, meta, percent)
+		}
+
+		err = meta.Normalize(rating.Windows)
+		if percent > 99 {
+			if err == nil {
+				t.Errorf("Normalize(%d) should fail outside the Windows table", percent)
+			}
+			continue
+		}
+		if err != nil || meta.Rating != stars {
+			t.Errorf("Normalize(%d) = %d, %v, want %d stars", percent, meta.Rating, err, stars)
+		}
+	}
+}
+
+func TestHasKeyword(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "lightroom-classic.xmp"))
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	meta, err := GetMetadata(data)
+	if err != nil {
+		t.Fatalf("GetMetadata() error = %v", err)
+	}
+
+	for keyword, want := range map[string]bool{
+		"Portfolio":       true,
+		"genre|landscape": true,
+		"Landscape":       true,
+		"Genre":           false,
+		"print":           false,
+	} {
+		if got := meta.HasKeyword(keyword); got != want {
+			t.Errorf("HasKeyword(%q) = %v, want %v", keyword, got, want)
+		}
+	}
+}
+
+func TestParseContainers(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "capture-one.xmp"))
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	packet, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	// rdf:Alt yields the x-default item first
+	if title, _ := packet.Get(NsDC, "title"); title != "Harbour" {
+		t.Errorf("Get(dc:title) = %q, want Harbour", title)
+	}
+	if titles := packet.Values(NsDC, "title"); len(titles) != 2 {
+		t.Errorf("Values(dc:title) = %v, want 2 items", titles)
+	}
+	// Properties of other descriptions are merged
+	if tool, _ := packet.Get(NsXMP, "CreatorTool"); tool != "Capture One 23 Macintosh" {
+		t.Errorf("Get(xmp:CreatorTool) = %q", tool)
+	}
+	// Syntax attributes are no properties
+	if _, ok := packet.Get(NsRDF, "about"); ok {
+		t.Error("rdf:about must not be reported as property")
+	}
+}
+
+// extendedPacket is an extended XMP packet as written by Lightroom
+const extendedPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:crs="http://ns.adobe.com/camera-raw-settings/1.0/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    crs:Exposure2012="+0.35" crs:Contrast2012="+12" xmp:Rating="1">
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>portfolio</rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+func TestExtractExtendedXmp(t *testing.T) {
+	tmpDir := t.TempDir()
+	jpgPath := filepath.Join(tmpDir, "extended.jpg")
+	if err := testutils.CreateTestJPEGWithExtendedXMP(t, jpgPath, 3, extendedPacket, 100); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	meta := extractMetadata(t, jpgPath)
+	// The standard packet takes precedence over the extended one
+	if meta.Rating != 3 {
+		t.Errorf("Rating = %d, want 3", meta.Rating)
+	}
+	if !meta.HasKeyword("portfolio") {
+		t.Errorf("Keywords = %v, want the keyword of the extended packet", meta.Keywords)
+	}
+
+	// A damaged extended packet fails the MD5 check and is left out
+	data, err := os.ReadFile(jpgPath)
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	damaged := bytes.Replace(data, []byte(`"+12"`), []byte(`"+13"`), 1)
+	if bytes.Equal(damaged, data) {
+		t.Fatal("Setup failed: extended packet not found")
+	}
+	if err := os.WriteFile(jpgPath, damaged, 0644); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	meta = extractMetadata(t, jpgPath)
+	if meta.Rating != 3 || len(meta.Keywords) != 0 {
+		t.Errorf("Metadata = %+v, want rating 3 of the standard packet only", meta)
+	}
+}
+
+func TestAssembleExtendedOversized(t *testing.T) {
+	guid := strings.Repeat("a", guidLength)
+	// A chunk header announcing ~4 GiB of extended XMP for 4 bytes of data
+	payload := append([]byte(ExtendedHeader+guid), 0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0)
+	payload = append(payload, "data"...)
+
+	if _, err := assembleExtended(guid, [][]byte{payload}); err == nil || !strings.Contains(err.Error(), "incomplete") {
+		t.Errorf("assembleExtended() error = %v, want the oversized chunk rejected", err)
+	}
+}
+
+func TestExtractHeifXmp(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, idat := range []bool{false, true} {
+		heifPath := filepath.Join(tmpDir, fmt.Sprintf("idat-%t.HIF", idat))
+		if err := testutils.CreateTestHEIFWithXMP(t, heifPath, 4, idat); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+		if meta := extractMetadata(t, heifPath); meta.Rating != 4 {
+			t.Errorf("Rating = %d, want 4 (idat %t)", meta.Rating, idat)
+		}
+	}
+
+	// Truncated files are rejected instead of read out of bounds
+	data, err := os.ReadFile(filepath.Join(tmpDir, "idat-false.HIF"))
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	for _, size := range []int{len(data) - 20, 200, 40} {
+		if _, err := ExtractHeifXmp(data[:size]); err == nil {
+			t.Errorf("ExtractHeifXmp() of %d bytes should fail", size)
+		}
+	}
+}
+
+// extractMetadata reads the metadata embedded in a JPEG or HEIF file
+func extractMetadata(t *testing.T, jpgPath string) *Metadata {
+	t.Helper()
+	file, err := os.Open(jpgPath)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer file.Close()
+
+	data, err := ExtractXmpData(file)
+	if err != nil {
+		t.Fatalf("ExtractXmpData() error = %v", err)
+	}
+	meta, err := GetMetadata(data)
+	if err != nil {
+		t.Fatalf("GetMetadata() error = %v", err)
+	}
+	return meta
+}
+
+func TestUpdate(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "darktable.xmp"))
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	updated, err := Update(data, &Metadata{Rating: 4, Rated: true, Label: "Green", Keywords: []string{"print", "DARKTABLE|format|raf"}})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	meta, err := GetMetadata(updated)
+	if err != nil {
+		t.Fatalf("GetMetadata() error = %v\n%s", err, updated)
+	}
+	if meta.Rating != 4 || meta.Label != "Green" {
+		t.Errorf("Rating = %d, Label = %q, want 4 and Green", meta.Rating, meta.Label)
+	}
+	if want := []string{"darktable|format|raf", "print"}; strings.Join(meta.Keywords, ",") != strings.Join(want, ",") {
+		t.Errorf("Keywords = %v, want %v", meta.Keywords, want)
+	}
+
+	// Other content is preserved
+	for _, keep := range []string{`darktable:operation="exposure"`, `xmpMM:DerivedFrom="DSCF6482.RAF"`, `x:xmptk="XMP Core 4.4.0-Exiv2"`} {
+		if !strings.Contains(string(updated), keep) {
+			t.Errorf("Update() dropped %s:\n%s", keep, updated)
+		}
+	}
+	if strings.Contains(string(updated), `xmp:Rating="1"`) {
+		t.Errorf("Update() kept the old rating:\n%s", updated)
+	}
+
+	// Nothing changes on a second update
+	again, err := Update(updated, &Metadata{Rating: 4, Rated: true, Keywords: []string{"Print"}})
+	if err != nil || string(again) != string(updated) {
+		t.Errorf("Update() changed an up-to-date packet: %v\n%s", err, again)
+	}
+}
+
+func TestUpdateNewPacket(t *testing.T) {
+	data, err := Update(nil, &Metadata{Rating: 2, Rated: true, Label: "R&D"})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	meta, err := GetMetadata(data)
+	if err != nil {
+		t.Fatalf("GetMetadata() error = %v\n%s", err, data)
+	}
+	if meta.Rating != 2 || meta.Label != "R&D" || len(meta.Keywords) != 0 {
+		t.Errorf("Metadata = %+v, want rating 2 and label R&D", meta)
+	}
+
+	// Nothing to write leaves the data empty
+	if data, err := Update(nil, &Metadata{}); err != nil || len(data) != 0 {
+		t.Errorf("Update() = %q, %v, want no data", data, err)
+	}
+}
+
 // Help function for the tests
 func CreateTestXMP(path string, rating int) error {
 	xmpContent := fmt.Sprintf(`<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>